@@ -1,127 +1,305 @@
 package bridge
 
 import (
-	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
-	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/eclipse/paho.mqtt.golang"
-	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/ratelimit"
 	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/wallbox"
 )
 
-var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
-	panic("Connection to MQTT lost")
-}
-
-func LaunchBridge(configPath string) {
-	c := LoadConfig(configPath)
-	w := wallbox.New()
-	w.RefreshData()
-
-	serialNumber := w.SerialNumber()
+func getAllEntities(w *wallbox.Wallbox, c *WallboxConfig, d *diagnostics, limit *energyLimit, cost *costTracker, smart *smartCharging, site *siteController, chargerName string) map[string]Entity {
 	entityConfig := getEntities(w)
+	optional := map[wallbox.Feature]func(*wallbox.Wallbox) map[string]Entity{
+		wallbox.FeaturePowerBoost:   getPowerBoostEntities,
+		wallbox.FeaturePowerSharing: getPowerSharingEntities,
+		wallbox.FeatureEcoSmart:     getEcoSmartEntities,
+		wallbox.FeatureUsers:        getUserEntities,
+	}
+	for feature, entities := range optional {
+		if !w.Supports(feature) {
+			continue
+		}
+		for k, v := range entities(w) {
+			entityConfig[k] = v
+		}
+	}
+	for k, v := range getDiagnosticEntities(d) {
+		entityConfig[k] = v
+	}
+	for k, v := range getEnergyLimitEntities(limit) {
+		entityConfig[k] = v
+	}
+	if c.costEnabled() {
+		for k, v := range getCostEntities(cost, c.Cost.Currency) {
+			entityConfig[k] = v
+		}
+	}
 	if c.Settings.DebugSensors {
 		for k, v := range getDebugEntities(w) {
 			entityConfig[k] = v
 		}
 	}
+	if c.SmartCharging.PriceTopic != "" {
+		for k, v := range getSmartChargingEntities(smart) {
+			entityConfig[k] = v
+		}
+	}
+	if c.Site.MaxCurrent > 0 {
+		for k, v := range getSiteEntities(site, chargerName) {
+			entityConfig[k] = v
+		}
+		// The site sets the current, the user's setting caps the share.
+		if e, ok := entityConfig["max_charging_current"]; ok {
+			e.Setter = func(val string) error { return site.setUserCurrent(chargerName, strToInt(val)) }
+			entityConfig["max_charging_current"] = e
+		}
+	}
+	return entityConfig
+}
 
-	topicPrefix := "wallbox_" + serialNumber
-	availabilityTopic := topicPrefix + "/availability"
+func discoveryTopic(serialNumber, key string, val Entity) string {
+	return "homeassistant/" + val.Component + "/" + serialNumber + "_" + key + "/config"
+}
 
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", c.MQTT.Host, c.MQTT.Port))
-	opts.SetUsername(c.MQTT.Username)
-	opts.SetPassword(c.MQTT.Password)
-	opts.SetWill(availabilityTopic, "offline", 1, true)
-	opts.OnConnectionLost = connectLostHandler
+// removeDiscovery clears the retained discovery config and state of an
+// entity, which makes Home Assistant drop it.
+func removeDiscovery(client mqttClient, qos byte, serialNumber, key string, val Entity) {
+	client.Publish(discoveryTopic(serialNumber, key, val), qos, true, nil, nil)
+	client.Publish("wallbox_"+serialNumber+"/"+key+"/state", qos, true, nil, nil)
+	if val.Attributes != nil {
+		client.Publish("wallbox_"+serialNumber+"/"+key+"/attributes", qos, true, nil, nil)
+	}
+}
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+// warnUnknownKeys logs what check-config would reject, without refusing to
+// run, since setup keeps sections and keys it does not know about.
+func warnUnknownKeys(unknown []string) {
+	for _, problem := range unknown {
+		slog.Warn("Ignoring config", "problem", problem)
 	}
+}
 
-	for key, val := range entityConfig {
-		component := val.Component
-		uid := serialNumber + "_" + key
-		config := map[string]interface{}{
-			"~":                  topicPrefix + "/" + key,
-			"availability_topic": availabilityTopic,
-			"state_topic":        "~/state",
-			"unique_id":          uid,
-			"device": map[string]string{
-				"identifiers": serialNumber,
-				"name":        c.Settings.DeviceName,
-			},
+func LaunchBridge(configPath string) {
+	c, unknown, err := loadConfig(configPath)
+	if err != nil {
+		// A typo may be why a setting is missing or invalid.
+		for _, problem := range unknown {
+			fmt.Fprintln(os.Stderr, "warning:", problem)
 		}
-		if val.Setter != nil {
-			config["command_topic"] = "~/set"
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	setupLogging(c)
+	warnUnknownKeys(unknown)
+
+	mqttConnects := &atomic.Int64{}
+	site := newSiteController(c, siteStatePath(configPath))
+	var chargers []*charger
+	for _, cc := range c.chargerConfigs() {
+		ch := newCharger(cc, c, configPath, mqttConnects, site)
+		// The others are served meanwhile, see charger.awaitConnection.
+		if err := ch.connect(c); err != nil {
+			slog.Error("Unable to connect to charger, retrying", "charger", cc.Name, "error", err)
 		}
-		for k, v := range val.Config {
-			config[k] = v
+		chargers = append(chargers, ch)
+	}
+
+	// The bridge's topics live under the first charger whose serial number
+	// is known, which takes waiting for one to be reached the first time.
+	var first *charger
+	for first == nil {
+		for _, ch := range chargers {
+			if ch.topicPrefix != "" {
+				first = ch
+				break
+			}
+		}
+		if first == nil {
+			time.Sleep(time.Duration(c.Settings.PollingIntervalSeconds) * time.Second)
+			for _, ch := range chargers {
+				if err := ch.connect(c); err != nil {
+					slog.Warn("Unable to connect to charger, retrying", "charger", ch.name, "error", err)
+				}
+			}
 		}
-		jsonPayload, _ := json.Marshal(config)
-		token := client.Publish("homeassistant/"+component+"/"+uid+"/config", 1, true, jsonPayload)
-		token.Wait()
 	}
 
-	token := client.Publish(availabilityTopic, 1, true, "online")
-	token.Wait()
+	// A single charger keeps using its own availability topic as the last
+	// will. With several, the will goes to a shared bridge topic that every
+	// entity also depends on.
+	willTopic := first.availabilityTopic()
+	if len(chargers) > 1 {
+		willTopic = first.topicPrefix + "/bridge_availability"
+		for _, ch := range chargers {
+			ch.bridgeAvailabilityTopic = willTopic
+		}
+	}
 
-	messageHandler := func(client mqtt.Client, msg mqtt.Message) {
-		field := strings.Split(msg.Topic(), "/")[1]
-		payload := string(msg.Payload())
-		setter := entityConfig[field].Setter
-		fmt.Println("Setting", field, payload)
-		setter(payload)
+	costPriceHandler := func(client mqttClient, msg *message) {
+		for _, ch := range chargers {
+			ch.cost.priceHandler(client, msg)
+		}
+	}
+	smartPriceHandler := func(client mqttClient, msg *message) {
+		for _, ch := range chargers {
+			ch.smart.priceHandler(client, msg)
+		}
 	}
 
-	topic := topicPrefix + "/+/set"
-	client.Subscribe(topic, 1, messageHandler)
+	commandQoS := byte(c.MQTT.QoSCommands)
+	availabilityQoS := byte(c.MQTT.QoSAvailability)
+	pub := newPublisher()
+	client, err := connectMQTT(c, willTopic, func(client mqttClient) {
+		if mqttConnects.Add(1) > 1 {
+			slog.Info("Reconnected to MQTT")
+		}
+		for _, ch := range chargers {
+			if ch.connected.Load() {
+				ch.subscribe(client, pub)
+				ch.republish.Store(true)
+			}
+		}
+		if priceTopic := chargers[0].cost.topic(); priceTopic != "" {
+			client.Subscribe(priceTopic, commandQoS, costPriceHandler)
+		}
+		if priceTopic := chargers[0].smart.topic(); priceTopic != "" {
+			client.Subscribe(priceTopic, commandQoS, smartPriceHandler)
+		}
+		if len(chargers) > 1 {
+			client.Publish(willTopic, availabilityQoS, true, []byte("online"), nil)
+		}
+	})
+	if err != nil {
+		panic(err)
+	}
+	// From here on publishing goes through a queue, as do command replies.
+	pub.start(client)
+	client = pub
+	if c.Logging.MQTT {
+		mirrorLogsToMQTT(client, first.topicPrefix+"/log")
+	}
+	for _, ch := range chargers {
+		slog.Info("Connected to MQTT", "broker", fmt.Sprintf("%s:%d", c.MQTT.Host, c.MQTT.Port), "protocol", client.ProtocolVersion(), "charger", ch.name, "serial", ch.serialNumber, "version", Version)
+		go ch.run(pub, c)
+	}
 
 	ticker := time.NewTicker(time.Duration(c.Settings.PollingIntervalSeconds) * time.Second)
 	defer ticker.Stop()
 
-	published := make(map[string]interface{})
-	rateLimiter := map[string]*ratelimit.DeltaRateLimit{
-		"charging_power": ratelimit.NewDeltaRateLimit(10, 100),
-		"added_energy":   ratelimit.NewDeltaRateLimit(10, 50),
+	status := bridgeStatus{
+		Version:   Version,
+		PID:       os.Getpid(),
+		StartedAt: chargers[0].diagnostics.startedAt,
 	}
 
+	interrupted := interrupt()
+	reload := hangup()
+
 	for {
 		select {
 		case <-ticker.C:
-			w.RefreshData()
-			for key, val := range entityConfig {
-				payload := val.Getter()
-				bytePayload := []byte(fmt.Sprint(payload))
-				if published[key] != payload {
-					if rate, ok := rateLimiter[key]; ok && !rate.Allow(strToFloat(payload)) {
-						continue
-					}
-					fmt.Println("Publishing: ", key, payload)
-					token := client.Publish(topicPrefix+"/"+key+"/state", 1, true, bytePayload)
-					token.Wait()
-					published[key] = payload
+			for _, ch := range chargers {
+				lastPoll := ch.diagnostics.lastPoll.Load()
+				if lastPoll > 0 && time.Unix(lastPoll, 0).After(status.LastPoll) {
+					status.LastPoll = time.Unix(lastPoll, 0)
 				}
 			}
-		case <-interrupt():
-			fmt.Println("Interrupted. Exiting...")
-			token := client.Publish(availabilityTopic, 1, true, "offline")
-			token.Wait()
-			client.Disconnect(250)
+			status.MQTTConnected = client.IsConnected()
+			if err := writeStatus(status); err != nil {
+				slog.Warn("Unable to write status", "error", err)
+			}
+		case <-reload:
+			slog.Info("Reloading config", "path", configPath)
+			newConfig, unknown, err := loadConfig(configPath)
+			warnUnknownKeys(unknown)
+			if err != nil {
+				slog.Error("Keeping current config", "error", err)
+				continue
+			}
+			if newConfig.MQTT != c.MQTT {
+				slog.Warn("MQTT settings changed, restart the bridge to apply them")
+			}
+			if newConfig.Logging.Format != c.Logging.Format || newConfig.Logging.MQTT != c.Logging.MQTT {
+				slog.Warn("Logging format or MQTT mirroring changed, restart the bridge to apply them")
+			}
+			if !sameChargers(c.chargerConfigs(), newConfig.chargerConfigs()) {
+				slog.Warn("Chargers or their connection settings changed, restart the bridge to apply them")
+			}
+			level, _ := parseLogLevel(newConfig.Logging.Level)
+			logLevel.Set(level)
+
+			site.configure(newConfig)
+			for _, ch := range chargers {
+				ch.cost.configure(newConfig)
+				ch.smart.configure(newConfig)
+			}
+			if newConfig.Cost.PriceTopic != c.Cost.PriceTopic {
+				if c.Cost.PriceTopic != "" {
+					client.Unsubscribe(c.Cost.PriceTopic)
+				}
+				if newConfig.Cost.PriceTopic != "" {
+					client.Subscribe(newConfig.Cost.PriceTopic, commandQoS, costPriceHandler)
+				}
+			}
+			if newConfig.SmartCharging.PriceTopic != c.SmartCharging.PriceTopic {
+				if c.SmartCharging.PriceTopic != "" {
+					client.Unsubscribe(c.SmartCharging.PriceTopic)
+				}
+				if newConfig.SmartCharging.PriceTopic != "" {
+					client.Subscribe(newConfig.SmartCharging.PriceTopic, commandQoS, smartPriceHandler)
+				}
+			}
+			for _, ch := range chargers {
+				cc, _ := newConfig.chargerConfig(ch.name)
+				ch.reload <- chargerReload{config: newConfig, deviceName: cc.DeviceName}
+			}
+
+			if newConfig.Settings.PollingIntervalSeconds != c.Settings.PollingIntervalSeconds {
+				ticker.Reset(time.Duration(newConfig.Settings.PollingIntervalSeconds) * time.Second)
+			}
+			c = newConfig
+		case <-interrupted:
+			slog.Info("Interrupted. Exiting...")
+			for _, ch := range chargers {
+				ch.shutdown()
+			}
+			if len(chargers) > 1 {
+				client.Publish(willTopic, availabilityQoS, true, []byte("offline"), nil)
+			}
+			client.Disconnect()
+			os.Remove(statusPath)
 			os.Exit(0)
 		}
 	}
 }
 
+// sameChargers reports whether two configs list the same chargers with the
+// same connection settings, which can not be changed without a restart.
+func sameChargers(a, b []ChargerConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Wallbox != b[i].Wallbox {
+			return false
+		}
+	}
+	return true
+}
+
 func interrupt() <-chan os.Signal {
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 	return interrupt
 }
+
+func hangup() <-chan os.Signal {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	return hangup
+}
@@ -0,0 +1,602 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/ratelimit"
+	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/wallbox"
+)
+
+// charger polls one Wallbox and publishes it as its own Home Assistant
+// device. All chargers share the bridge's MQTT connection.
+type charger struct {
+	name       string
+	deviceName string
+	// connection is how to reach the charger, changing it takes a restart.
+	connection WallboxSection
+	// serialPath keeps the serial number from an earlier run, so that a
+	// charger that can not be reached at start can be marked unavailable.
+	serialPath string
+	// connected is set once the charger has been reached. Until then only
+	// run may use wallbox, serialNumber, topicPrefix and entityConfig.
+	connected    atomic.Bool
+	wallbox      *wallbox.Wallbox
+	serialNumber string
+	topicPrefix  string
+	// mqtt holds the MQTT settings the bridge was started with, changing
+	// them takes a restart.
+	mqtt MQTTSection
+	// bridgeAvailabilityTopic is set when several chargers share the
+	// connection, as the last will then can not cover each of them.
+	bridgeAvailabilityTopic string
+
+	diagnostics *diagnostics
+	limit       *energyLimit
+	cost        *costTracker
+	smart       *smartCharging
+	site        *siteController
+
+	// holds are the reasons the bridge has paused charging for, paused is
+	// whether it has.
+	holdMutex sync.Mutex
+	holds     map[string]bool
+	paused    bool
+	// readAt is when the wallbox data was last read, only used by run.
+	readAt time.Time
+	// users are the users the entities were built with, only used by run.
+	users []wallbox.User
+
+	// republish is set on reconnect, states published while the
+	// connection was down may have been lost.
+	republish atomic.Bool
+
+	entityMutex  sync.RWMutex
+	entityConfig map[string]Entity
+
+	reload chan chargerReload
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type chargerReload struct {
+	config *WallboxConfig
+	// deviceName is empty when the charger is no longer in the config.
+	deviceName string
+}
+
+// chargerStatePath names a file the bridge keeps next to its config for one
+// of the chargers.
+func chargerStatePath(configPath, chargerName, suffix string) string {
+	base := strings.TrimSuffix(configPath, filepath.Ext(configPath))
+	if chargerName != "" {
+		base += "." + chargerName
+	}
+	return base + suffix
+}
+
+// newCharger sets up a charger without reaching it yet, see connect.
+func newCharger(cc ChargerConfig, c *WallboxConfig, configPath string, mqttConnects *atomic.Int64, site *siteController) *charger {
+	ch := &charger{
+		name:        cc.Name,
+		deviceName:  cc.DeviceName,
+		connection:  cc.Wallbox,
+		serialPath:  chargerStatePath(configPath, cc.Name, ".serial"),
+		diagnostics: newDiagnostics(mqttConnects),
+		limit:       &energyLimit{},
+		cost:        newCostTracker(c, chargerStatePath(configPath, cc.Name, ".cost.json")),
+		smart:       newSmartCharging(c),
+		site:        site,
+		mqtt:        c.MQTT,
+		holds:       map[string]bool{},
+		reload:      make(chan chargerReload, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if serial, err := os.ReadFile(ch.serialPath); err == nil && len(bytes.TrimSpace(serial)) > 0 {
+		ch.setSerialNumber(string(bytes.TrimSpace(serial)))
+	}
+	return ch
+}
+
+// connect reaches the charger and builds its entities. A charger that can
+// not be reached at start is retried from run.
+func (ch *charger) connect(c *WallboxConfig) error {
+	w, err := wallbox.Connect(ch.connection.wallboxConfig())
+	if err != nil {
+		return err
+	}
+	if err := w.RefreshData(); err != nil {
+		w.Close()
+		return err
+	}
+
+	ch.wallbox = w
+	if serial := w.SerialNumber(); serial != ch.serialNumber {
+		ch.setSerialNumber(serial)
+		if err := os.WriteFile(ch.serialPath, []byte(serial+"\n"), 0644); err != nil {
+			slog.Warn("Unable to save serial number", "charger", ch.name, "error", err)
+		}
+	}
+	entityConfig := ch.entities(c)
+	ch.entityMutex.Lock()
+	ch.entityConfig = entityConfig
+	ch.entityMutex.Unlock()
+	ch.site.attach(ch.name, ch.applySiteShare)
+	ch.connected.Store(true)
+	return nil
+}
+
+func (ch *charger) setSerialNumber(serial string) {
+	ch.serialNumber = serial
+	ch.topicPrefix = "wallbox_" + serial
+}
+
+func (ch *charger) availabilityTopic() string {
+	return ch.topicPrefix + "/availability"
+}
+
+func (ch *charger) entities(c *WallboxConfig) map[string]Entity {
+	ch.users = ch.wallbox.Data().Users
+	return getAllEntities(ch.wallbox, c, ch.diagnostics, ch.limit, ch.cost, ch.smart, ch.site, ch.name)
+}
+
+// messageHandler runs a command. MQTT 5 commands with a response topic get
+// the outcome back as JSON.
+func (ch *charger) messageHandler(client mqttClient, msg *message) {
+	field := strings.Split(msg.Topic, "/")[1]
+	payload := string(msg.Payload)
+	ch.entityMutex.RLock()
+	setter := ch.entityConfig[field].Setter
+	ch.entityMutex.RUnlock()
+
+	result := map[string]string{"entity": field, "value": payload, "result": "ok"}
+	if setter == nil {
+		slog.Warn("Ignoring command for unknown entity", "serial", ch.serialNumber, "entity", field, "value", payload)
+		result["result"] = "error"
+		result["error"] = "unknown entity"
+	} else {
+		slog.Info("Setting", "serial", ch.serialNumber, "entity", field, "value", payload)
+		if err := setter(payload); err != nil {
+			slog.Error("Unable to set", "serial", ch.serialNumber, "entity", field, "value", payload, "error", err)
+			result["result"] = "error"
+			result["error"] = err.Error()
+		}
+		ch.diagnostics.commandsProcessed.Add(1)
+	}
+
+	response, _ := json.Marshal(result)
+	respond(client, byte(ch.mqtt.QoSCommands), msg, "", response)
+}
+
+// stateTopic carries all states as one JSON message, see publishState.
+func (ch *charger) stateTopic() string {
+	return ch.topicPrefix + "/state"
+}
+
+// subscribe is called on every (re)connect. Replies go through pub.
+func (ch *charger) subscribe(client mqttClient, pub *publisher) {
+	qos := byte(ch.mqtt.QoSCommands)
+	client.Subscribe(ch.topicPrefix+"/+/set", qos, pub.handler(ch.messageHandler))
+	client.Subscribe(ch.topicPrefix+"/sessions/export", qos, pub.handler(sessionsExportHandler(ch.wallbox, qos)))
+	client.Publish(ch.availabilityTopic(), byte(ch.mqtt.QoSAvailability), true, []byte("online"), nil)
+}
+
+func (ch *charger) publishDiscovery(client mqttClient) {
+	for key, val := range ch.entityConfig {
+		uid := ch.serialNumber + "_" + key
+		config := map[string]interface{}{
+			"~":         ch.topicPrefix + "/" + key,
+			"unique_id": uid,
+			"device": map[string]string{
+				"identifiers": ch.serialNumber,
+				"name":        ch.deviceName,
+			},
+		}
+		if ch.bridgeAvailabilityTopic == "" {
+			config["availability_topic"] = ch.availabilityTopic()
+		} else {
+			config["availability"] = []map[string]string{
+				{"topic": ch.bridgeAvailabilityTopic},
+				{"topic": ch.availabilityTopic()},
+			}
+			config["availability_mode"] = "all"
+		}
+		if val.Getter != nil && ch.mqtt.entityStates() {
+			config["state_topic"] = "~/state"
+		} else if val.Getter != nil {
+			config["state_topic"] = ch.stateTopic()
+			config["value_template"] = "{{ value_json." + key + " }}"
+		}
+		if ch.hasAttributes(val) {
+			config["json_attributes_topic"] = "~/attributes"
+		}
+		if val.Setter != nil {
+			config["command_topic"] = "~/set"
+		}
+		for k, v := range val.Config {
+			config[k] = v
+		}
+		jsonPayload, _ := json.Marshal(config)
+		client.Publish(discoveryTopic(ch.serialNumber, key, val), byte(ch.mqtt.QoSDiscovery), true, jsonPayload, nil)
+	}
+}
+
+// hasAttributes reports whether the entity gets an attributes topic.
+func (ch *charger) hasAttributes(val Entity) bool {
+	return val.Attributes != nil || (ch.mqtt.StateTimestamps && val.Getter != nil)
+}
+
+func (ch *charger) refresh(c *WallboxConfig) {
+	pollStart := time.Now()
+	if err := ch.wallbox.RefreshData(); err != nil {
+		if errors.Is(err, wallbox.ErrRedis) {
+			ch.diagnostics.redisErrors.Add(1)
+		} else {
+			ch.diagnostics.sqlErrors.Add(1)
+		}
+		slog.Error("Unable to refresh data", "serial", ch.serialNumber, "error", err)
+		return
+	}
+	ch.diagnostics.pollSucceeded(time.Since(pollStart))
+	ch.readAt = pollStart
+	ch.setHold(holdEnergyLimit, ch.limit.update(ch.wallbox))
+	if c.costEnabled() {
+		ch.cost.update(ch.wallbox)
+	}
+	ch.setHold(holdSmartCharging, c.SmartCharging.PriceTopic != "" && ch.smart.update(ch.wallbox))
+	ch.balance()
+}
+
+// Reasons for the bridge to pause charging. Charging resumes once none is
+// left, so that one controller does not undo another's pause.
+const (
+	holdEnergyLimit   = "energy_limit"
+	holdSmartCharging = "smart_charging"
+	holdSite          = "site"
+)
+
+// hold pauses or resumes charging as reasons to pause come and go. Only a
+// pause made by the bridge is lifted.
+func (ch *charger) hold(reason string, on bool) error {
+	ch.holdMutex.Lock()
+	defer ch.holdMutex.Unlock()
+	if on {
+		ch.holds[reason] = true
+	} else {
+		delete(ch.holds, reason)
+	}
+	paused := len(ch.holds) > 0
+	if paused == ch.paused {
+		return nil
+	}
+	enable := 1
+	if paused {
+		enable = 0
+	}
+	if err := ch.wallbox.SetChargingEnable(enable); err != nil {
+		return err
+	}
+	ch.paused = paused
+	if paused {
+		slog.Info("Pausing charging", "serial", ch.serialNumber, "reason", reason)
+	} else {
+		slog.Info("Resuming charging", "serial", ch.serialNumber)
+	}
+	return nil
+}
+
+func (ch *charger) setHold(reason string, on bool) {
+	if err := ch.hold(reason, on); err != nil {
+		slog.Error("Unable to set charging enable", "serial", ch.serialNumber, "reason", reason, "error", err)
+	}
+}
+
+func (ch *charger) held(reasons ...string) bool {
+	ch.holdMutex.Lock()
+	defer ch.holdMutex.Unlock()
+	for _, reason := range reasons {
+		if ch.holds[reason] {
+			return true
+		}
+	}
+	return false
+}
+
+// balance reports to the site controller, which applies this and the other
+// chargers' shares. A charger the site has paused still wants current.
+func (ch *charger) balance() {
+	w := ch.wallbox
+	active := w.CableConnected() == 1 && !ch.held(holdEnergyLimit, holdSmartCharging) && (ch.held(holdSite) || w.WantsCurrent())
+	ch.site.report(ch.name, active, w.AvailableCurrent(), w.Data().SQL.MaxChargingCurrent)
+}
+
+// applySiteShare sets the max charging current to the charger's share of
+// the site current, zero pauses it.
+func (ch *charger) applySiteShare(current int) error {
+	if current == 0 {
+		return ch.hold(holdSite, true)
+	}
+	if err := ch.wallbox.SetMaxChargingCurrent(current); err != nil {
+		return err
+	}
+	return ch.hold(holdSite, false)
+}
+
+// run polls the charger until stopped. The entity map is only replaced from
+// here, so reading it without the lock is fine in this goroutine.
+func (ch *charger) run(pub *publisher, c *WallboxConfig) {
+	defer close(ch.done)
+	var client mqttClient = pub
+
+	ticker := time.NewTicker(time.Duration(c.Settings.PollingIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	if !ch.connected.Load() {
+		var ok bool
+		if c, ok = ch.awaitConnection(pub, ticker, c); !ok {
+			return
+		}
+	}
+	ch.publishDiscovery(client)
+
+	published := make(map[string]interface{})
+	publishedAttributes := make(map[string]string)
+	publishedState := ""
+	lastValue := make(map[string]string)
+	changedAt := make(map[string]time.Time)
+	publishedAt := make(map[string]time.Time)
+	// last_poll is a timestamp, which has no delta to compare, so it is
+	// published once a minute.
+	rateLimiter := map[string]*ratelimit.DeltaRateLimit{
+		"charging_power": ratelimit.NewDeltaRateLimit(10, 100),
+		"added_energy":   ratelimit.NewDeltaRateLimit(10, 50),
+		"bridge_uptime":  ratelimit.NewDeltaRateLimit(60, 3600),
+		"last_poll":      ratelimit.NewDeltaRateLimit(60, math.Inf(1)),
+		"poll_duration":  ratelimit.NewDeltaRateLimit(60, 1000),
+	}
+
+	// replaceEntities removes entities that are gone from Home Assistant and
+	// publishes the discovery of the rest, which may have changed.
+	replaceEntities := func(newEntityConfig map[string]Entity) {
+		for key, val := range ch.entityConfig {
+			if _, ok := newEntityConfig[key]; !ok {
+				removeDiscovery(client, byte(ch.mqtt.QoSDiscovery), ch.serialNumber, key, val)
+				delete(published, key)
+				delete(publishedAttributes, key)
+				delete(lastValue, key)
+				delete(changedAt, key)
+			}
+		}
+		ch.entityMutex.Lock()
+		ch.entityConfig = newEntityConfig
+		ch.entityMutex.Unlock()
+		ch.publishDiscovery(client)
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			ch.refresh(c)
+			if users := ch.wallbox.Data().Users; !slices.Equal(users, ch.users) {
+				slog.Info("Users changed, updating unlock options", "serial", ch.serialNumber, "users", len(users))
+				replaceEntities(ch.entities(c))
+			}
+			if ch.republish.Swap(false) {
+				clear(published)
+				clear(publishedAttributes)
+				publishedState = ""
+				clear(publishedAt)
+			}
+			expiry := time.Duration(ch.mqtt.MessageExpirySeconds) * time.Second
+			qos := byte(ch.mqtt.QoSState)
+			now := time.Now()
+			updated := map[string]bool{}
+			// With a message expiry, unchanged values are republished before
+			// the broker drops them.
+			stale := func(topic string) bool {
+				return expiry > 0 && now.Sub(publishedAt[topic]) > expiry/2
+			}
+			for key, val := range ch.entityConfig {
+				if val.Getter == nil {
+					continue
+				}
+				payload := val.Getter()
+				if value, ok := lastValue[key]; !ok || value != payload {
+					lastValue[key] = payload
+					changedAt[key] = now
+				}
+				bytePayload := []byte(fmt.Sprint(payload))
+				topic := ch.topicPrefix + "/" + key + "/state"
+				if published[key] != payload || stale(topic) {
+					if rate, ok := rateLimiter[key]; ok && !rate.Allow(strToFloat(payload)) {
+						continue
+					}
+					if ch.mqtt.entityStates() {
+						slog.Debug("Publishing", "serial", ch.serialNumber, "entity", key, "value", payload)
+						// A state that is not queued is tried again next poll.
+						if err := client.Publish(topic, qos, ch.mqtt.retain(key), bytePayload, telemetryProperties(val, now, expiry)); err != nil {
+							continue
+						}
+					}
+					published[key] = payload
+					publishedAt[topic] = now
+					updated[key] = true
+				}
+			}
+			if ch.mqtt.jsonState() {
+				state := jsonState(published, ch.entityConfig)
+				values, _ := json.Marshal(state)
+				if (publishedState != string(values) || stale(ch.stateTopic())) && ch.publishState(client, state, now, expiry) == nil {
+					publishedState = string(values)
+					publishedAt[ch.stateTopic()] = now
+				}
+			}
+			for key, val := range ch.entityConfig {
+				if !ch.hasAttributes(val) {
+					continue
+				}
+				attributes := map[string]interface{}{}
+				if val.Attributes != nil {
+					attributes = val.Attributes()
+				}
+				values, _ := json.Marshal(attributes)
+				topic := ch.topicPrefix + "/" + key + "/attributes"
+				// Timestamps go out with the state they belong to.
+				timestamps := ch.mqtt.StateTimestamps && val.Getter != nil
+				if publishedAttributes[key] != string(values) || stale(topic) || (timestamps && updated[key]) {
+					payload := values
+					if timestamps {
+						payload, _ = json.Marshal(ch.timestamped(attributes, val, changedAt[key], now))
+					}
+					if client.Publish(topic, qos, true, payload, telemetryProperties(Entity{}, now, expiry)) != nil {
+						continue
+					}
+					publishedAttributes[key] = string(values)
+					publishedAt[topic] = now
+				}
+			}
+		case r := <-ch.reload:
+			if r.deviceName != "" {
+				ch.deviceName = r.deviceName
+			}
+			replaceEntities(ch.entities(r.config))
+
+			if r.config.Settings.PollingIntervalSeconds != c.Settings.PollingIntervalSeconds {
+				ticker.Reset(time.Duration(r.config.Settings.PollingIntervalSeconds) * time.Second)
+			}
+			c = r.config
+		case <-ch.stop:
+			client.Publish(ch.availabilityTopic(), byte(ch.mqtt.QoSAvailability), true, []byte("offline"), nil)
+			if c.costEnabled() {
+				ch.cost.close()
+			}
+			ch.wallbox.Close()
+			return
+		}
+	}
+}
+
+// awaitConnection retries a charger that could not be reached at start,
+// which is marked unavailable meanwhile, until it connects or the bridge
+// stops. It returns the config to run with and whether it connected.
+func (ch *charger) awaitConnection(pub *publisher, ticker *time.Ticker, c *WallboxConfig) (*WallboxConfig, bool) {
+	if ch.topicPrefix != "" {
+		pub.Publish(ch.availabilityTopic(), byte(ch.mqtt.QoSAvailability), true, []byte("offline"), nil)
+	}
+	for {
+		select {
+		case <-ticker.C:
+			if err := ch.connect(c); err != nil {
+				slog.Warn("Unable to connect to charger, retrying", "charger", ch.name, "error", err)
+				continue
+			}
+			slog.Info("Connected to charger", "charger", ch.name, "serial", ch.serialNumber)
+			ch.subscribe(pub, pub)
+			return c, true
+		case r := <-ch.reload:
+			if r.deviceName != "" {
+				ch.deviceName = r.deviceName
+			}
+			if r.config.Settings.PollingIntervalSeconds != c.Settings.PollingIntervalSeconds {
+				ticker.Reset(time.Duration(r.config.Settings.PollingIntervalSeconds) * time.Second)
+			}
+			c = r.config
+		case <-ch.stop:
+			return c, false
+		}
+	}
+}
+
+// timestamped adds when the entity's value was read and last changed, and
+// where it was read from, to its attributes. Values the bridge works out
+// itself are read on every poll.
+func (ch *charger) timestamped(attributes map[string]interface{}, val Entity, changedAt, now time.Time) map[string]interface{} {
+	readAt := now
+	if val.source() != sourceBridge {
+		readAt = ch.readAt
+	}
+	timestamped := make(map[string]interface{}, len(attributes)+3)
+	for k, v := range attributes {
+		timestamped[k] = v
+	}
+	timestamped["read_at"] = readAt.UTC().Format(time.RFC3339)
+	timestamped["changed_at"] = changedAt.UTC().Format(time.RFC3339)
+	timestamped["source"] = val.source()
+	return timestamped
+}
+
+// jsonState maps the published states to JSON values. Numeric states are
+// numbers, text states stay strings and unknown values are null.
+func jsonState(published map[string]interface{}, entities map[string]Entity) map[string]interface{} {
+	state := make(map[string]interface{}, len(published))
+	for key, value := range published {
+		if value == "None" {
+			state[key] = nil
+		} else if number, ok := jsonNumber(entities[key], value); ok {
+			state[key] = number
+		} else {
+			state[key] = value
+		}
+	}
+	return state
+}
+
+// jsonNumber parses a state as a number when the entity measures something
+// or the state reads as a plain number. Text entities and diagnostics such as
+// the bridge version stay strings.
+func jsonNumber(val Entity, value interface{}) (float64, bool) {
+	_, unit := val.Config["unit_of_measurement"]
+	_, stateClass := val.Config["state_class"]
+	if !unit && !stateClass && (val.Component == "select" || val.Component == "text" || val.Config["entity_category"] == "diagnostic") {
+		return 0, false
+	}
+	text := fmt.Sprint(value)
+	number, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, false
+	}
+	// Keep values such as "007" or "1.10" as written.
+	if !unit && !stateClass && strconv.FormatFloat(number, 'f', -1, 64) != text {
+		return 0, false
+	}
+	return number, true
+}
+
+// publishState publishes the states as one retained JSON message with the
+// time they were read, for consumers that prefer it over a topic per entity.
+func (ch *charger) publishState(client mqttClient, state map[string]interface{}, now time.Time, expiry time.Duration) error {
+	state["timestamp"] = now.UTC().Format(time.RFC3339)
+	payload, _ := json.Marshal(state)
+	return client.Publish(ch.stateTopic(), byte(ch.mqtt.QoSState), true, payload, telemetryProperties(Entity{}, now, expiry))
+}
+
+// telemetryProperties tags a state with its unit and the time it was read,
+// for MQTT 5 consumers other than Home Assistant.
+func telemetryProperties(val Entity, now time.Time, expiry time.Duration) *publishProperties {
+	props := &publishProperties{
+		Expiry: expiry,
+		User:   map[string]string{"timestamp": now.UTC().Format(time.RFC3339)},
+	}
+	if unit, ok := val.Config["unit_of_measurement"].(string); ok {
+		props.User["unit"] = unit
+	}
+	return props
+}
+
+func (ch *charger) shutdown() {
+	close(ch.stop)
+	<-ch.done
+}
@@ -1,37 +1,473 @@
 package bridge
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/wallbox"
 	"gopkg.in/ini.v1"
 )
 
 type WallboxConfig struct {
-	MQTT struct {
-		Host     string `ini:"host"`
-		Port     int    `ini:"port"`
-		Username string `ini:"username"`
-		Password string `ini:"password"`
-	} `ini:"mqtt"`
+	MQTT MQTTSection `ini:"mqtt"`
 
 	Settings struct {
 		PollingIntervalSeconds int    `ini:"polling_interval_seconds"`
 		DeviceName             string `ini:"device_name"`
 		DebugSensors           bool   `ini:"debug_sensors"`
 	} `ini:"settings"`
+
+	Logging struct {
+		Level  string `ini:"level"`
+		Format string `ini:"format"`
+		MQTT   bool   `ini:"mqtt"`
+	} `ini:"logging"`
+
+	Cost struct {
+		Price      float64 `ini:"price"`
+		Tariff     string  `ini:"tariff"`
+		PriceTopic string  `ini:"price_topic"`
+		Currency   string  `ini:"currency"`
+	} `ini:"cost"`
+
+	Wallbox WallboxSection `ini:"wallbox"`
+
+	SmartCharging struct {
+		PriceTopic      string  `ini:"price_topic"`
+		ChargingPowerKW float64 `ini:"charging_power_kw"`
+	} `ini:"smart_charging"`
+
+	Site struct {
+		MaxCurrent int    `ini:"max_current"`
+		MinCurrent int    `ini:"min_current"`
+		Strategy   string `ini:"strategy"`
+	} `ini:"site"`
+
+	// Chargers are read from [charger.<name>] sections, see chargerConfigs.
+	Chargers []ChargerConfig `ini:"-"`
 }
 
-func (w *WallboxConfig) SaveTo(path string) {
-	cfg := ini.Empty()
-	cfg.ReflectFrom(w)
-	cfg.SaveTo(path)
+type MQTTSection struct {
+	Host     string `ini:"host"`
+	Port     int    `ini:"port"`
+	Username string `ini:"username"`
+	Password string `ini:"password"`
+	// Protocol is auto, 5 or 3.1.1.
+	Protocol             string `ini:"protocol"`
+	MessageExpirySeconds int    `ini:"message_expiry_seconds"`
+	ClientID             string `ini:"client_id"`
+	CleanSession         bool   `ini:"clean_session"`
+	QoSDiscovery         int    `ini:"qos_discovery"`
+	QoSState             int    `ini:"qos_state"`
+	QoSAvailability      int    `ini:"qos_availability"`
+	QoSCommands          int    `ini:"qos_commands"`
+	// Unretained lists entities whose state is published without retain,
+	// separated by commas.
+	Unretained string `ini:"unretained"`
+	// StateTopics is entities, both or json, see the state topic constants.
+	StateTopics string `ini:"state_topics"`
+	// StateTimestamps adds read_at, changed_at and source attributes to
+	// every entity.
+	StateTimestamps bool `ini:"state_timestamps"`
 }
 
-func LoadConfig(path string) *WallboxConfig {
-	cfg, _ := ini.Load(path)
+const (
+	// stateTopicsEntities publishes a state topic per entity.
+	stateTopicsEntities = "entities"
+	// stateTopicsBoth also publishes all states as one JSON message.
+	stateTopicsBoth = "both"
+	// stateTopicsJSON only publishes the JSON message, and Home Assistant
+	// reads the entities from it.
+	stateTopicsJSON = "json"
+)
+
+type WallboxSection struct {
+	MySQLDSN          string `ini:"mysql_dsn"`
+	RedisURL          string `ini:"redis_url"`
+	TimeoutSeconds    int    `ini:"timeout_seconds"`
+	MySQLMaxOpenConns int    `ini:"mysql_max_open_conns"`
+	MySQLMaxIdleConns int    `ini:"mysql_max_idle_conns"`
+	RedisPoolSize     int    `ini:"redis_pool_size"`
+	HelperAddr        string `ini:"helper_addr"`
+	HelperToken       string `ini:"helper_token"`
+}
 
-	var config WallboxConfig
-	if err := cfg.MapTo(&config); err != nil {
-		return nil
+// ChargerConfig is one [charger.<name>] section. It takes any [wallbox] key,
+// falling back to the values in [wallbox].
+type ChargerConfig struct {
+	Name       string         `ini:"-"`
+	DeviceName string         `ini:"device_name"`
+	Priority   int            `ini:"priority"`
+	Wallbox    WallboxSection `ini:"-"`
+}
+
+const chargerSectionPrefix = "charger."
+
+// ConfigError lists every problem found in a config file so that they can
+// all be fixed in one go.
+type ConfigError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config %s:\n  %s", e.Path, strings.Join(e.Problems, "\n  "))
+}
+
+func (w *WallboxConfig) costEnabled() bool {
+	return w.Cost.Price > 0 || w.Cost.Tariff != "" || w.Cost.PriceTopic != ""
+}
+
+func (s MQTTSection) retain(key string) bool {
+	for _, unretained := range strings.Split(s.Unretained, ",") {
+		if strings.TrimSpace(unretained) == key {
+			return false
+		}
 	}
+	return true
+}
 
+func (s MQTTSection) entityStates() bool {
+	return s.StateTopics != stateTopicsJSON
+}
+
+func (s MQTTSection) jsonState() bool {
+	return s.StateTopics == stateTopicsBoth || s.StateTopics == stateTopicsJSON
+}
+
+// toolConfig returns a copy of the config for short-lived connections made
+// from the command line, which must not take over the running bridge's
+// client ID and session.
+func (w *WallboxConfig) toolConfig() *WallboxConfig {
+	tool := *w
+	tool.MQTT.ClientID = ""
+	tool.MQTT.CleanSession = true
+	return &tool
+}
+
+func (s WallboxSection) wallboxConfig() wallbox.Config {
+	return wallbox.Config{
+		MySQLDSN:          s.MySQLDSN,
+		RedisURL:          s.RedisURL,
+		Timeout:           time.Duration(s.TimeoutSeconds) * time.Second,
+		MySQLMaxOpenConns: s.MySQLMaxOpenConns,
+		MySQLMaxIdleConns: s.MySQLMaxIdleConns,
+		RedisPoolSize:     s.RedisPoolSize,
+		HelperAddr:        s.HelperAddr,
+		HelperToken:       s.HelperToken,
+	}
+}
+
+func (s WallboxSection) validate(section string) []string {
+	var problems []string
+	if err := s.wallboxConfig().Validate(); err != nil {
+		problems = append(problems, fmt.Sprintf("%s: %s", section, err))
+	}
+	if s.TimeoutSeconds < 1 {
+		problems = append(problems, fmt.Sprintf("%s.timeout_seconds %d must be at least 1", section, s.TimeoutSeconds))
+	}
+	if s.MySQLMaxOpenConns < 0 || s.MySQLMaxIdleConns < 0 || s.RedisPoolSize < 0 {
+		problems = append(problems, fmt.Sprintf("%s pool sizes must not be negative", section))
+	}
+	if s.HelperAddr != "" && s.HelperToken == "" {
+		problems = append(problems, fmt.Sprintf("%s.helper_addr needs a %s.helper_token", section, section))
+	}
+	return problems
+}
+
+// chargerConfigs returns the configured chargers, or a single unnamed one
+// built from [settings] and [wallbox] when there are no [charger.*] sections.
+func (w *WallboxConfig) chargerConfigs() []ChargerConfig {
+	if len(w.Chargers) > 0 {
+		return w.Chargers
+	}
+	return []ChargerConfig{{DeviceName: w.Settings.DeviceName, Wallbox: w.Wallbox}}
+}
+
+func (w *WallboxConfig) chargerConfig(name string) (ChargerConfig, bool) {
+	for _, charger := range w.chargerConfigs() {
+		if charger.Name == name {
+			return charger, true
+		}
+	}
+	return ChargerConfig{}, false
+}
+
+func defaultConfig() *WallboxConfig {
+	config := WallboxConfig{}
+	config.MQTT.Host = "127.0.0.1"
+	config.MQTT.Port = 1883
+	config.MQTT.Protocol = "auto"
+	config.MQTT.CleanSession = true
+	config.MQTT.QoSDiscovery = 1
+	config.MQTT.QoSState = 1
+	config.MQTT.QoSAvailability = 1
+	config.MQTT.QoSCommands = 1
+	config.MQTT.StateTopics = stateTopicsEntities
+	config.Settings.PollingIntervalSeconds = 1
+	config.Settings.DeviceName = "Wallbox"
+	config.Logging.Level = "info"
+	config.Logging.Format = "text"
+	config.Cost.Currency = "EUR"
+	config.SmartCharging.ChargingPowerKW = 7.4
+	config.Site.MinCurrent = 6
+	config.Site.Strategy = siteStrategyEqual
+	config.Wallbox.MySQLDSN = wallbox.DefaultMySQLDSN
+	config.Wallbox.RedisURL = wallbox.DefaultRedisURL
+	config.Wallbox.TimeoutSeconds = 5
 	return &config
 }
+
+// loadConfigOrDefaults reads whatever it can from path on top of the
+// defaults, without validating, so that setup can offer existing values.
+func loadConfigOrDefaults(path string) *WallboxConfig {
+	config := defaultConfig()
+	if cfg, err := ini.Load(path); err == nil {
+		cfg.MapTo(config)
+		config.mapChargers(cfg, false)
+	}
+	return config
+}
+
+// mapChargers reads the [charger.<name>] sections, each on top of [wallbox].
+func (w *WallboxConfig) mapChargers(cfg *ini.File, strict bool) error {
+	mapTo := (*ini.Section).MapTo
+	if strict {
+		mapTo = (*ini.Section).StrictMapTo
+	}
+	for _, section := range cfg.Sections() {
+		name, ok := strings.CutPrefix(section.Name(), chargerSectionPrefix)
+		if !ok {
+			continue
+		}
+		charger := ChargerConfig{Name: name, DeviceName: name, Wallbox: w.Wallbox}
+		if err := mapTo(section, &charger); err != nil {
+			return err
+		}
+		if err := mapTo(section, &charger.Wallbox); err != nil {
+			return err
+		}
+		w.Chargers = append(w.Chargers, charger)
+	}
+	return nil
+}
+
+// SaveTo writes the config to path, keeping any other sections, keys and
+// comments already in the file. The previous file is kept as path.bak and
+// the new one is moved into place atomically.
+func (w *WallboxConfig) SaveTo(path string) error {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		cfg = ini.Empty()
+	}
+	if err := cfg.ReflectFrom(w); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if previous, err := os.ReadFile(path); err == nil {
+		if err := os.WriteFile(path+".bak", previous, 0600); err != nil {
+			return err
+		}
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := cfg.WriteTo(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// LoadConfig reads and validates the config, unknown sections and keys are
+// errors too.
+func LoadConfig(path string) (*WallboxConfig, error) {
+	config, unknown, err := loadConfig(path)
+	var configErr *ConfigError
+	if errors.As(err, &configErr) {
+		configErr.Problems = append(unknown, configErr.Problems...)
+		return nil, configErr
+	} else if err != nil {
+		return nil, err
+	}
+	if len(unknown) > 0 {
+		return nil, &ConfigError{Path: path, Problems: unknown}
+	}
+	return config, nil
+}
+
+// loadConfig reads and validates the config. Unknown sections and keys are
+// returned separately, also when the config is invalid, so that callers can
+// decide whether they are fatal; the bridge only warns, as SaveTo keeps them.
+func loadConfig(path string) (*WallboxConfig, []string, error) {
+	cfg, err := ini.Load(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("config file %s does not exist", path)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("unable to read config %s: %w", path, err)
+	}
+
+	config := defaultConfig()
+	unknown := unknownKeys(cfg, reflect.TypeOf(*config))
+	if err := cfg.StrictMapTo(config); err != nil {
+		return nil, unknown, &ConfigError{Path: path, Problems: []string{err.Error()}}
+	}
+
+	if err := config.mapChargers(cfg, true); err != nil {
+		return nil, unknown, &ConfigError{Path: path, Problems: []string{err.Error()}}
+	}
+
+	if problems := config.validate(); len(problems) > 0 {
+		return nil, unknown, &ConfigError{Path: path, Problems: problems}
+	}
+
+	return config, unknown, nil
+}
+
+func (w *WallboxConfig) validate() []string {
+	var problems []string
+	if strings.TrimSpace(w.MQTT.Host) == "" {
+		problems = append(problems, "mqtt.host must not be empty")
+	}
+	if w.MQTT.Port < 1 || w.MQTT.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("mqtt.port %d is out of range (1-65535)", w.MQTT.Port))
+	}
+	if p := w.MQTT.Protocol; p != "auto" && p != "5" && p != "3.1.1" {
+		problems = append(problems, fmt.Sprintf("mqtt.protocol %q must be auto, 5 or 3.1.1", p))
+	}
+	if w.MQTT.MessageExpirySeconds < 0 {
+		problems = append(problems, fmt.Sprintf("mqtt.message_expiry_seconds %d must not be negative", w.MQTT.MessageExpirySeconds))
+	}
+	for _, qos := range []struct {
+		name  string
+		value int
+	}{
+		{"qos_discovery", w.MQTT.QoSDiscovery},
+		{"qos_state", w.MQTT.QoSState},
+		{"qos_availability", w.MQTT.QoSAvailability},
+		{"qos_commands", w.MQTT.QoSCommands},
+	} {
+		if qos.value < 0 || qos.value > 2 {
+			problems = append(problems, fmt.Sprintf("mqtt.%s %d must be 0, 1 or 2", qos.name, qos.value))
+		}
+	}
+	if t := w.MQTT.StateTopics; t != stateTopicsEntities && t != stateTopicsBoth && t != stateTopicsJSON {
+		problems = append(problems, fmt.Sprintf("mqtt.state_topics %q must be entities, both or json", t))
+	}
+	if !w.MQTT.CleanSession && strings.TrimSpace(w.MQTT.ClientID) == "" {
+		problems = append(problems, "mqtt.clean_session = false needs a mqtt.client_id")
+	}
+	if w.Settings.PollingIntervalSeconds < 1 {
+		problems = append(problems, fmt.Sprintf("settings.polling_interval_seconds %d must be at least 1", w.Settings.PollingIntervalSeconds))
+	}
+	if strings.TrimSpace(w.Settings.DeviceName) == "" {
+		problems = append(problems, "settings.device_name must not be empty")
+	}
+	if _, err := parseLogLevel(w.Logging.Level); err != nil {
+		problems = append(problems, fmt.Sprintf("logging.level %q must be one of debug, info, warn or error", w.Logging.Level))
+	}
+	if format := strings.ToLower(w.Logging.Format); format != "text" && format != "json" {
+		problems = append(problems, fmt.Sprintf("logging.format %q must be text or json", w.Logging.Format))
+	}
+	if w.Cost.Price < 0 {
+		problems = append(problems, fmt.Sprintf("cost.price %v must not be negative", w.Cost.Price))
+	}
+	if _, err := parseTariff(w.Cost.Tariff); err != nil {
+		problems = append(problems, fmt.Sprintf("cost.tariff: %s", err))
+	}
+	if w.costEnabled() && strings.TrimSpace(w.Cost.Currency) == "" {
+		problems = append(problems, "cost.currency must not be empty")
+	}
+	problems = append(problems, w.Wallbox.validate("wallbox")...)
+	for _, charger := range w.Chargers {
+		section := chargerSectionPrefix + charger.Name
+		if charger.Name == "" || strings.ContainsAny(charger.Name, " /#+") {
+			problems = append(problems, fmt.Sprintf("[%s] needs a name without spaces, '/', '#' or '+'", section))
+		}
+		if strings.TrimSpace(charger.DeviceName) == "" {
+			problems = append(problems, fmt.Sprintf("%s.device_name must not be empty", section))
+		}
+		problems = append(problems, charger.Wallbox.validate(section)...)
+	}
+	if w.SmartCharging.ChargingPowerKW <= 0 {
+		problems = append(problems, fmt.Sprintf("smart_charging.charging_power_kw %v must be positive", w.SmartCharging.ChargingPowerKW))
+	}
+	if w.Site.MaxCurrent < 0 {
+		problems = append(problems, fmt.Sprintf("site.max_current %d must not be negative", w.Site.MaxCurrent))
+	}
+	if w.Site.MinCurrent < 1 {
+		problems = append(problems, fmt.Sprintf("site.min_current %d must be at least 1", w.Site.MinCurrent))
+	}
+	if !siteStrategies[w.Site.Strategy] {
+		problems = append(problems, fmt.Sprintf("site.strategy %q must be equal, priority or first_come", w.Site.Strategy))
+	}
+	return problems
+}
+
+// unknownKeys reports sections and keys that do not map to any field in typ,
+// which usually means a typo that would otherwise be silently ignored.
+func unknownKeys(cfg *ini.File, typ reflect.Type) []string {
+	sections := map[string]reflect.Type{}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		sections[field.Tag.Get("ini")] = field.Type
+	}
+	chargerKeys := iniKeys(reflect.TypeOf(ChargerConfig{}))
+	for key := range iniKeys(reflect.TypeOf(WallboxSection{})) {
+		chargerKeys[key] = true
+	}
+
+	var problems []string
+	for _, section := range cfg.Sections() {
+		name := section.Name()
+		var keys map[string]bool
+		if sectionType, ok := sections[name]; ok && name != "-" {
+			keys = iniKeys(sectionType)
+		} else if strings.HasPrefix(name, chargerSectionPrefix) {
+			keys = chargerKeys
+		} else {
+			if name == ini.DefaultSection && len(section.Keys()) == 0 {
+				continue
+			}
+			problems = append(problems, fmt.Sprintf("unknown section [%s]", name))
+			continue
+		}
+
+		for _, key := range section.KeyStrings() {
+			if !keys[key] {
+				problems = append(problems, fmt.Sprintf("unknown key %q in section [%s]", key, name))
+			}
+		}
+	}
+
+	return problems
+}
+
+func iniKeys(typ reflect.Type) map[string]bool {
+	keys := map[string]bool{}
+	for i := 0; i < typ.NumField(); i++ {
+		if key := typ.Field(i).Tag.Get("ini"); key != "-" {
+			keys[key] = true
+		}
+	}
+	return keys
+}
@@ -0,0 +1,247 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/wallbox"
+)
+
+const costSaveInterval = 5 * time.Minute
+
+type tariffPeriod struct {
+	start time.Duration
+	end   time.Duration
+	price float64
+}
+
+func (p tariffPeriod) contains(offset time.Duration) bool {
+	if p.start <= p.end {
+		return offset >= p.start && offset < p.end
+	}
+	return offset >= p.start || offset < p.end
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(clock, "%d:%d", &hours, &minutes); err != nil {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	if hours < 0 || hours > 24 || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// parseTariff parses a time-of-use table such as
+// "00:00-07:00=0.12, 07:00-22:00=0.30, 22:00-24:00=0.12". Periods may wrap
+// around midnight.
+func parseTariff(tariff string) ([]tariffPeriod, error) {
+	var periods []tariffPeriod
+	for _, entry := range strings.Split(tariff, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		span, price, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("tariff entry %q must look like 07:00-22:00=0.30", entry)
+		}
+		from, to, ok := strings.Cut(span, "-")
+		if !ok {
+			return nil, fmt.Errorf("tariff entry %q must look like 07:00-22:00=0.30", entry)
+		}
+
+		var period tariffPeriod
+		var err error
+		if period.start, err = parseClock(strings.TrimSpace(from)); err != nil {
+			return nil, err
+		}
+		if period.end, err = parseClock(strings.TrimSpace(to)); err != nil {
+			return nil, err
+		}
+		if period.end == 24*time.Hour {
+			period.end = 0
+		}
+		if period.price, err = strconv.ParseFloat(strings.TrimSpace(price), 64); err != nil {
+			return nil, fmt.Errorf("invalid tariff price %q", price)
+		}
+		periods = append(periods, period)
+	}
+	return periods, nil
+}
+
+// costTracker turns increases in the charger's cumulative energy counter
+// into money, using the price from the MQTT price topic, the tariff table
+// or the fixed price, in that order.
+type costTracker struct {
+	mutex      sync.Mutex
+	statePath  string
+	price      float64
+	tariff     []tariffPeriod
+	priceTopic string
+
+	enabled       bool
+	topicPrice    float64
+	hasTopicPrice bool
+	cableState    int
+	savedAt       time.Time
+
+	SessionCost float64 `json:"session_cost"`
+	TotalCost   float64 `json:"total_cost"`
+	// LastEnergy is the energy counter the costs are up to, kept across
+	// restarts so that energy charged meanwhile is costed too.
+	LastEnergy *float64 `json:"last_energy,omitempty"`
+}
+
+func newCostTracker(c *WallboxConfig, statePath string) *costTracker {
+	t := &costTracker{statePath: statePath, cableState: -1}
+	t.configure(c)
+	if data, err := os.ReadFile(statePath); err == nil {
+		if err := json.Unmarshal(data, t); err != nil {
+			slog.Warn("Ignoring unreadable cost state", "path", statePath, "error", err)
+		}
+	}
+	return t
+}
+
+func (t *costTracker) configure(c *WallboxConfig) {
+	tariff, _ := parseTariff(c.Cost.Tariff)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.price = c.Cost.Price
+	t.tariff = tariff
+	if t.priceTopic != c.Cost.PriceTopic {
+		t.hasTopicPrice = false
+	}
+	t.priceTopic = c.Cost.PriceTopic
+	// Energy charged while tracking was off is not costed.
+	if enabled := c.costEnabled(); enabled != t.enabled {
+		t.enabled = enabled
+		t.LastEnergy = nil
+	}
+}
+
+func (t *costTracker) currentPrice(now time.Time) float64 {
+	if t.hasTopicPrice {
+		return t.topicPrice
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	for _, period := range t.tariff {
+		if period.contains(offset) {
+			return period.price
+		}
+	}
+	return t.price
+}
+
+func (t *costTracker) topic() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.priceTopic
+}
+
+func (t *costTracker) priceHandler(client mqttClient, msg *message) {
+	price, err := strconv.ParseFloat(strings.TrimSpace(string(msg.Payload)), 64)
+	if err != nil {
+		slog.Warn("Ignoring invalid price", "topic", msg.Topic, "payload", string(msg.Payload))
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if msg.Topic != t.priceTopic {
+		return
+	}
+	t.topicPrice = price
+	t.hasTopicPrice = true
+}
+
+func (t *costTracker) update(w *wallbox.Wallbox) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	cableState := w.CableConnected()
+	if cableState == 1 && t.cableState == 0 {
+		t.SessionCost = 0
+	}
+	t.cableState = cableState
+
+	energy := w.Data().SQL.CumulativeAddedEnergy
+	if t.LastEnergy != nil && energy > *t.LastEnergy {
+		cost := (energy - *t.LastEnergy) / 1000 * t.currentPrice(time.Now())
+		t.SessionCost += cost
+		t.TotalCost += cost
+	}
+	t.LastEnergy = &energy
+
+	if time.Since(t.savedAt) > costSaveInterval {
+		t.save()
+	}
+}
+
+// save persists the accumulated cost, the caller must hold the mutex.
+func (t *costTracker) save() {
+	t.savedAt = time.Now()
+	data, _ := json.Marshal(t)
+	tmpPath := t.statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		slog.Warn("Unable to save cost state", "error", err)
+		return
+	}
+	if err := os.Rename(tmpPath, t.statePath); err != nil {
+		slog.Warn("Unable to save cost state", "error", err)
+	}
+}
+
+func (t *costTracker) close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.save()
+}
+
+func (t *costTracker) sessionCost() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return strconv.FormatFloat(t.SessionCost, 'f', 2, 64)
+}
+
+func (t *costTracker) totalCost() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return strconv.FormatFloat(t.TotalCost, 'f', 2, 64)
+}
+
+func getCostEntities(t *costTracker, currency string) map[string]Entity {
+	return map[string]Entity{
+		"session_cost": {
+			Component: "sensor",
+			Getter:    t.sessionCost,
+			Config: map[string]interface{}{
+				"name":                        "Session cost",
+				"device_class":                "monetary",
+				"unit_of_measurement":         currency,
+				"state_class":                 "total",
+				"suggested_display_precision": "2",
+			},
+		},
+		"total_cost": {
+			Component: "sensor",
+			Getter:    t.totalCost,
+			Config: map[string]interface{}{
+				"name":                        "Total cost",
+				"device_class":                "monetary",
+				"unit_of_measurement":         currency,
+				"state_class":                 "total",
+				"suggested_display_precision": "2",
+			},
+		},
+	}
+}
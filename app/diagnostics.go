@@ -0,0 +1,130 @@
+package bridge
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// diagnostics holds the bridge's own health counters for one charger. They
+// are updated from both the poll loop and the MQTT client's goroutines. The
+// MQTT connection count is shared by all chargers.
+type diagnostics struct {
+	startedAt         time.Time
+	lastPoll          atomic.Int64
+	pollDuration      atomic.Int64
+	redisErrors       atomic.Int64
+	sqlErrors         atomic.Int64
+	mqttConnects      *atomic.Int64
+	commandsProcessed atomic.Int64
+}
+
+func newDiagnostics(mqttConnects *atomic.Int64) *diagnostics {
+	return &diagnostics{startedAt: time.Now(), mqttConnects: mqttConnects}
+}
+
+func (d *diagnostics) pollSucceeded(duration time.Duration) {
+	d.lastPoll.Store(time.Now().Unix())
+	d.pollDuration.Store(duration.Milliseconds())
+}
+
+func (d *diagnostics) mqttReconnects() int64 {
+	connects := d.mqttConnects.Load()
+	if connects == 0 {
+		return 0
+	}
+	return connects - 1
+}
+
+func (d *diagnostics) lastPollTimestamp() string {
+	lastPoll := d.lastPoll.Load()
+	if lastPoll == 0 {
+		return "None"
+	}
+	return time.Unix(lastPoll, 0).UTC().Format(time.RFC3339)
+}
+
+func getDiagnosticEntities(d *diagnostics) map[string]Entity {
+	return map[string]Entity{
+		"bridge_version": {
+			Component: "sensor",
+			Getter:    func() string { return Version },
+			Config: map[string]interface{}{
+				"name":            "Bridge version",
+				"icon":            "mdi:information-outline",
+				"entity_category": "diagnostic",
+			},
+		},
+		"bridge_uptime": {
+			Component: "sensor",
+			Getter:    func() string { return fmt.Sprint(int64(time.Since(d.startedAt).Seconds())) },
+			Config: map[string]interface{}{
+				"name":                "Bridge uptime",
+				"device_class":        "duration",
+				"unit_of_measurement": "s",
+				"entity_category":     "diagnostic",
+			},
+		},
+		"last_poll": {
+			Component: "sensor",
+			Getter:    d.lastPollTimestamp,
+			Config: map[string]interface{}{
+				"name":            "Last poll",
+				"device_class":    "timestamp",
+				"entity_category": "diagnostic",
+			},
+		},
+		"poll_duration": {
+			Component: "sensor",
+			Getter:    func() string { return strconv.FormatInt(d.pollDuration.Load(), 10) },
+			Config: map[string]interface{}{
+				"name":                "Poll duration",
+				"device_class":        "duration",
+				"unit_of_measurement": "ms",
+				"state_class":         "measurement",
+				"entity_category":     "diagnostic",
+			},
+		},
+		"redis_errors": {
+			Component: "sensor",
+			Getter:    func() string { return strconv.FormatInt(d.redisErrors.Load(), 10) },
+			Config: map[string]interface{}{
+				"name":            "Redis errors",
+				"state_class":     "total_increasing",
+				"icon":            "mdi:database-alert",
+				"entity_category": "diagnostic",
+			},
+		},
+		"mysql_errors": {
+			Component: "sensor",
+			Getter:    func() string { return strconv.FormatInt(d.sqlErrors.Load(), 10) },
+			Config: map[string]interface{}{
+				"name":            "MySQL errors",
+				"state_class":     "total_increasing",
+				"icon":            "mdi:database-alert",
+				"entity_category": "diagnostic",
+			},
+		},
+		"mqtt_reconnects": {
+			Component: "sensor",
+			Getter:    func() string { return strconv.FormatInt(d.mqttReconnects(), 10) },
+			Config: map[string]interface{}{
+				"name":            "MQTT reconnects",
+				"state_class":     "total_increasing",
+				"icon":            "mdi:lan-disconnect",
+				"entity_category": "diagnostic",
+			},
+		},
+		"commands_processed": {
+			Component: "sensor",
+			Getter:    func() string { return strconv.FormatInt(d.commandsProcessed.Load(), 10) },
+			Config: map[string]interface{}{
+				"name":            "Commands processed",
+				"state_class":     "total_increasing",
+				"icon":            "mdi:console",
+				"entity_category": "diagnostic",
+			},
+		},
+	}
+}
@@ -0,0 +1,91 @@
+package bridge
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+
+	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/wallbox"
+)
+
+// energyLimit pauses charging once the session has added a target amount of
+// energy. The target is cleared when the cable is unplugged, a target set
+// before plugging in applies to the next session.
+type energyLimit struct {
+	mutex      sync.Mutex
+	target     float64
+	reached    bool
+	cableState int
+}
+
+func (e *energyLimit) set(val string) error {
+	target, err := strconv.ParseFloat(val, 64)
+	if err != nil || target < 0 {
+		return fmt.Errorf("invalid session energy limit %q", val)
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.target = target
+	e.reached = false
+	return nil
+}
+
+func (e *energyLimit) get() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return fmt.Sprint(e.target)
+}
+
+// update reports whether charging should be paused, which it is from when
+// the target is reached until the cable is unplugged or the target changed.
+func (e *energyLimit) update(w *wallbox.Wallbox) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	cableState := w.CableConnected()
+	if cableState == 0 && e.cableState == 1 {
+		if e.target != 0 {
+			slog.Info("Cable unplugged, clearing session energy limit")
+		}
+		e.target = 0
+		e.reached = false
+	}
+	e.cableState = cableState
+	if cableState == 0 {
+		return false
+	}
+
+	if e.target == 0 || e.reached || !w.IsCharging() {
+		return e.reached
+	}
+
+	addedEnergy := w.Data().RedisState.ScheduleEnergy
+	if addedEnergy < e.target*1000 {
+		return false
+	}
+
+	slog.Info("Session energy limit reached, pausing", "limit_kwh", e.target, "added_wh", addedEnergy)
+	e.reached = true
+	return true
+}
+
+func getEnergyLimitEntities(e *energyLimit) map[string]Entity {
+	return map[string]Entity{
+		"session_energy_limit": {
+			Component: "number",
+			Setter:    e.set,
+			Getter:    e.get,
+			Config: map[string]interface{}{
+				"name":                "Session energy limit",
+				"min":                 "0",
+				"max":                 "100",
+				"step":                "0.5",
+				"mode":                "box",
+				"unit_of_measurement": "kWh",
+				"device_class":        "energy",
+				"icon":                "mdi:battery-charging-high",
+			},
+		},
+	}
+}
@@ -0,0 +1,37 @@
+package bridge
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/wallbox"
+)
+
+// RunHelper runs the small command forwarder used when the bridge itself
+// runs off the charger, see helper_addr in the [wallbox] section.
+func RunHelper(args []string) {
+	flags := flag.NewFlagSet("helper", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:7070", "address to accept bridge connections on")
+	token := flags.String("token", os.Getenv("BRIDGE_HELPER_TOKEN"), "shared secret, must match helper_token (default $BRIDGE_HELPER_TOKEN)")
+	flags.Parse(args)
+
+	// Anyone who can reach the helper could otherwise unlock the charger.
+	if *token == "" {
+		fmt.Fprintln(os.Stderr, "helper: a token is required, set --token or $BRIDGE_HELPER_TOKEN")
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	slog.Info("Helper listening", "address", listener.Addr().String(), "version", Version)
+	if err := wallbox.ServeHelper(listener, *token); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,90 @@
+package bridge
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+var logLevel slog.LevelVar
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+func setupLogging(c *WallboxConfig) {
+	level, _ := parseLogLevel(c.Logging.Level)
+	logLevel.Set(level)
+
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	var handler slog.Handler
+	if strings.EqualFold(c.Logging.Format, "json") {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// mirrorLogsToMQTT additionally publishes warnings and errors as JSON to
+// topic, so they can be read remotely without access to journald.
+func mirrorLogsToMQTT(client mqttClient, topic string) {
+	writer := &mqttLogWriter{client: client, topic: topic}
+	mirror := slog.NewJSONHandler(writer, &slog.HandlerOptions{Level: slog.LevelWarn})
+	slog.SetDefault(slog.New(teeHandler{slog.Default().Handler(), mirror}))
+}
+
+type mqttLogWriter struct {
+	client mqttClient
+	topic  string
+}
+
+func (m *mqttLogWriter) Write(p []byte) (int, error) {
+	if !m.client.IsConnected() {
+		return len(p), nil
+	}
+	payload := strings.TrimSpace(string(p))
+	m.client.Publish(m.topic, 0, false, []byte(payload), &publishProperties{KeepQueued: true})
+	return len(p), nil
+}
+
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
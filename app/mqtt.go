@@ -0,0 +1,132 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const (
+	mqttConnectTimeout = 10 * time.Second
+	mqttPublishTimeout = 10 * time.Second
+)
+
+var errPublishTimeout = errors.New("timed out publishing")
+
+// message is an incoming MQTT message. The response topic and correlation
+// data are only set by MQTT 5 senders.
+type message struct {
+	Topic           string
+	Payload         []byte
+	ResponseTopic   string
+	CorrelationData []byte
+}
+
+type messageHandler func(client mqttClient, msg *message)
+
+// publishProperties are only sent when connected with MQTT 5, 3.1.1 brokers
+// get the plain message.
+type publishProperties struct {
+	Expiry          time.Duration
+	CorrelationData []byte
+	User            map[string]string
+	// KeepQueued is not sent. It stops the publisher from replacing a
+	// message still queued for the same topic, for replies and logs where
+	// every message counts.
+	KeepQueued bool
+}
+
+// mqttClient is what the bridge needs from an MQTT connection, implemented
+// for both MQTT 3.1.1 and MQTT 5. Publish waits until the message is sent,
+// or for mqttPublishTimeout, except on the queueing publisher.
+type mqttClient interface {
+	Publish(topic string, qos byte, retained bool, payload []byte, props *publishProperties) error
+	Subscribe(topic string, qos byte, handler messageHandler) error
+	Unsubscribe(topic string) error
+	IsConnected() bool
+	Disconnect()
+	ProtocolVersion() string
+}
+
+// connectMQTT connects with the protocol from the config, for "auto" MQTT 5
+// is used when the broker supports it. The will publishes "offline" to
+// willTopic, and onConnect is called on every (re)connect.
+func connectMQTT(c *WallboxConfig, willTopic string, onConnect func(mqttClient)) (mqttClient, error) {
+	switch c.MQTT.Protocol {
+	case "5":
+		return newMQTT5Client(c, willTopic, onConnect)
+	case "3.1.1":
+		return newMQTT3Client(c, willTopic, onConnect)
+	}
+	if brokerSupportsMQTT5(c) {
+		return newMQTT5Client(c, willTopic, onConnect)
+	}
+	return newMQTT3Client(c, willTopic, onConnect)
+}
+
+// brokerSupportsMQTT5 makes a single MQTT 5 connection attempt. Brokers that
+// only speak 3.1.1 either close the connection or refuse the protocol
+// version, anything else means MQTT 5 works.
+func brokerSupportsMQTT5(c *WallboxConfig) bool {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", c.MQTT.Host, c.MQTT.Port), mqttConnectTimeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttConnectTimeout)
+	defer cancel()
+	client := paho.NewClient(paho.ClientConfig{Conn: conn})
+	connack, err := client.Connect(ctx, &paho.Connect{
+		KeepAlive:    30,
+		CleanStart:   true,
+		Username:     c.MQTT.Username,
+		UsernameFlag: c.MQTT.Username != "",
+		Password:     []byte(c.MQTT.Password),
+		PasswordFlag: c.MQTT.Password != "",
+	})
+	if err == nil {
+		client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		return true
+	}
+	return connack != nil && connack.ReasonCode != packets.ConnackUnsupportedProtocolVersion
+}
+
+// respond publishes a reply to the request's MQTT 5 response topic, or to
+// fallback when there is none. An empty fallback means no reply.
+func respond(client mqttClient, qos byte, request *message, fallback string, payload []byte) {
+	topic := request.ResponseTopic
+	if topic == "" {
+		topic = fallback
+	}
+	if topic == "" {
+		return
+	}
+	props := &publishProperties{CorrelationData: request.CorrelationData, KeepQueued: true}
+	if err := client.Publish(topic, qos, false, payload, props); err != nil {
+		slog.Warn("Unable to publish response", "topic", topic, "error", err)
+	}
+}
+
+// topicMatches reports whether topic matches a subscription filter with
+// MQTT + and # wildcards.
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,80 @@
+package bridge
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
+	slog.Warn("Connection to MQTT lost, reconnecting", "error", err)
+}
+
+func mqttOptions(c *WallboxConfig) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", c.MQTT.Host, c.MQTT.Port))
+	opts.SetUsername(c.MQTT.Username)
+	opts.SetPassword(c.MQTT.Password)
+	opts.SetClientID(c.MQTT.ClientID)
+	opts.SetCleanSession(c.MQTT.CleanSession)
+	opts.SetConnectTimeout(mqttConnectTimeout)
+	return opts
+}
+
+// mqtt3Client speaks MQTT 3.1.1, publish properties are dropped.
+type mqtt3Client struct {
+	client mqtt.Client
+}
+
+func newMQTT3Client(c *WallboxConfig, willTopic string, onConnect func(mqttClient)) (*mqtt3Client, error) {
+	m := &mqtt3Client{}
+	opts := mqttOptions(c)
+	if willTopic != "" {
+		opts.SetWill(willTopic, "offline", byte(c.MQTT.QoSAvailability), true)
+	}
+	opts.OnConnectionLost = connectLostHandler
+	if onConnect != nil {
+		opts.SetOnConnectHandler(func(mqtt.Client) { onConnect(m) })
+	}
+
+	m.client = mqtt.NewClient(opts)
+	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return m, nil
+}
+
+func (m *mqtt3Client) Publish(topic string, qos byte, retained bool, payload []byte, props *publishProperties) error {
+	token := m.client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		return errPublishTimeout
+	}
+	return token.Error()
+}
+
+func (m *mqtt3Client) Subscribe(topic string, qos byte, handler messageHandler) error {
+	token := m.client.Subscribe(topic, qos, func(_ mqtt.Client, msg mqtt.Message) {
+		handler(m, &message{Topic: msg.Topic(), Payload: msg.Payload()})
+	})
+	token.Wait()
+	return token.Error()
+}
+
+func (m *mqtt3Client) Unsubscribe(topic string) error {
+	token := m.client.Unsubscribe(topic)
+	token.Wait()
+	return token.Error()
+}
+
+func (m *mqtt3Client) IsConnected() bool {
+	return m.client.IsConnectionOpen()
+}
+
+func (m *mqtt3Client) Disconnect() {
+	m.client.Disconnect(250)
+}
+
+func (m *mqtt3Client) ProtocolVersion() string {
+	return "3.1.1"
+}
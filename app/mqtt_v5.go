@@ -0,0 +1,179 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// mqtt5Client speaks MQTT 5 and reconnects on its own. Subscriptions are
+// routed here since autopaho hands every message to one callback.
+type mqtt5Client struct {
+	manager   atomic.Pointer[autopaho.ConnectionManager]
+	connected atomic.Bool
+
+	mutex    sync.RWMutex
+	handlers map[string]messageHandler
+	lastErr  error
+}
+
+func newMQTT5Client(c *WallboxConfig, willTopic string, onConnect func(mqttClient)) (*mqtt5Client, error) {
+	server, err := url.Parse(fmt.Sprintf("mqtt://%s:%d", c.MQTT.Host, c.MQTT.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mqtt5Client{handlers: map[string]messageHandler{}}
+	config := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{server},
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: c.MQTT.CleanSession,
+		ConnectTimeout:                mqttConnectTimeout,
+		ConnectUsername:               c.MQTT.Username,
+		ConnectPassword:               []byte(c.MQTT.Password),
+		OnConnectionUp: func(manager *autopaho.ConnectionManager, _ *paho.Connack) {
+			m.manager.Store(manager)
+			m.connected.Store(true)
+			if onConnect != nil {
+				onConnect(m)
+			}
+		},
+		OnConnectError: func(err error) {
+			m.mutex.Lock()
+			m.lastErr = err
+			m.mutex.Unlock()
+			slog.Warn("Unable to connect to MQTT", "error", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){m.route},
+			OnClientError: func(err error) {
+				m.connected.Store(false)
+				slog.Warn("Connection to MQTT lost, reconnecting", "error", err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				m.connected.Store(false)
+				slog.Warn("Disconnected by MQTT broker, reconnecting", "reason", d.ReasonCode)
+			},
+		},
+	}
+	config.ClientID = c.MQTT.ClientID
+	if !c.MQTT.CleanSession {
+		// Keep the session like MQTT 3.1.1 does without clean session.
+		config.SessionExpiryInterval = math.MaxUint32
+	}
+	if willTopic != "" {
+		config.WillMessage = &paho.WillMessage{Topic: willTopic, Payload: []byte("offline"), QoS: byte(c.MQTT.QoSAvailability), Retain: true}
+	}
+
+	manager, err := autopaho.NewConnection(context.Background(), config)
+	if err != nil {
+		return nil, err
+	}
+	m.manager.Store(manager)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*mqttConnectTimeout)
+	defer cancel()
+	if err := manager.AwaitConnection(ctx); err != nil {
+		manager.Disconnect(context.Background())
+		m.mutex.RLock()
+		defer m.mutex.RUnlock()
+		if m.lastErr != nil {
+			return nil, m.lastErr
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *mqtt5Client) route(received paho.PublishReceived) (bool, error) {
+	publish := received.Packet
+	msg := &message{Topic: publish.Topic, Payload: publish.Payload}
+	if publish.Properties != nil {
+		msg.ResponseTopic = publish.Properties.ResponseTopic
+		msg.CorrelationData = publish.Properties.CorrelationData
+	}
+
+	var handlers []messageHandler
+	m.mutex.RLock()
+	for filter, handler := range m.handlers {
+		if topicMatches(filter, publish.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	m.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(m, msg)
+	}
+	return len(handlers) > 0, nil
+}
+
+func (m *mqtt5Client) Publish(topic string, qos byte, retained bool, payload []byte, props *publishProperties) error {
+	publish := &paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: payload}
+	if props != nil {
+		publish.Properties = &paho.PublishProperties{CorrelationData: props.CorrelationData}
+		if props.Expiry > 0 {
+			expiry := uint32(props.Expiry.Seconds())
+			publish.Properties.MessageExpiry = &expiry
+		}
+		keys := make([]string, 0, len(props.User))
+		for key := range props.User {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			publish.Properties.User.Add(key, props.User[key])
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttPublishTimeout)
+	defer cancel()
+	_, err := m.manager.Load().Publish(ctx, publish)
+	return err
+}
+
+func (m *mqtt5Client) Subscribe(topic string, qos byte, handler messageHandler) error {
+	m.mutex.Lock()
+	m.handlers[topic] = handler
+	m.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttPublishTimeout)
+	defer cancel()
+	_, err := m.manager.Load().Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}},
+	})
+	return err
+}
+
+func (m *mqtt5Client) Unsubscribe(topic string) error {
+	m.mutex.Lock()
+	delete(m.handlers, topic)
+	m.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttPublishTimeout)
+	defer cancel()
+	_, err := m.manager.Load().Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{topic}})
+	return err
+}
+
+func (m *mqtt5Client) IsConnected() bool {
+	return m.connected.Load()
+}
+
+func (m *mqtt5Client) Disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), mqttPublishTimeout)
+	defer cancel()
+	m.manager.Load().Disconnect(ctx)
+}
+
+func (m *mqtt5Client) ProtocolVersion() string {
+	return "5"
+}
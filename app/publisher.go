@@ -0,0 +1,133 @@
+package bridge
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	publishQueueSize  = 1024
+	publishDrainLimit = 5 * time.Second
+)
+
+var (
+	errPublishQueueFull = errors.New("publish queue full")
+	errPublisherClosed  = errors.New("publisher closed")
+)
+
+type publication struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+	props    *publishProperties
+}
+
+// publisher queues outgoing messages for a single goroutine so that a slow
+// broker does not hold up polling or command handling. A message replaces
+// one still queued for the same topic, as only the latest value matters,
+// unless it asks to keep it. Everything but Publish goes straight to the
+// client.
+type publisher struct {
+	mqttClient
+	queue   chan *publication
+	done    chan struct{}
+	dropped atomic.Int64
+
+	mutex   sync.Mutex
+	pending map[string]*publication
+	closed  bool
+}
+
+// newPublisher returns a publisher that queues messages until start.
+func newPublisher() *publisher {
+	return &publisher{
+		queue:   make(chan *publication, publishQueueSize),
+		done:    make(chan struct{}),
+		pending: map[string]*publication{},
+	}
+}
+
+// start sends what is queued over client. From then on the publisher can be
+// used as the connection.
+func (p *publisher) start(client mqttClient) {
+	p.mqttClient = client
+	go p.run()
+}
+
+// handler makes h publish through the queue rather than on the connection
+// it is called with, where waiting for a slow broker would hold up the
+// delivery of other messages.
+func (p *publisher) handler(h messageHandler) messageHandler {
+	return func(_ mqttClient, msg *message) {
+		h(p, msg)
+	}
+}
+
+// Publish queues the message and returns without waiting for it to be sent.
+func (p *publisher) Publish(topic string, qos byte, retained bool, payload []byte, props *publishProperties) error {
+	pub := &publication{topic: topic, qos: qos, retained: retained, payload: payload, props: props}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return errPublisherClosed
+	}
+	keep := props != nil && props.KeepQueued
+	if queued, ok := p.pending[topic]; ok && !keep {
+		*queued = *pub
+		return nil
+	}
+	select {
+	case p.queue <- pub:
+		if !keep {
+			p.pending[topic] = pub
+		}
+		return nil
+	default:
+		p.dropped.Add(1)
+		return errPublishQueueFull
+	}
+}
+
+func (p *publisher) run() {
+	defer close(p.done)
+	for queued := range p.queue {
+		p.mutex.Lock()
+		if p.pending[queued.topic] == queued {
+			delete(p.pending, queued.topic)
+		}
+		pub := *queued
+		p.mutex.Unlock()
+
+		// QoS 0 is fire and forget, which also keeps failures to mirror
+		// logs from being logged and mirrored again.
+		err := p.mqttClient.Publish(pub.topic, pub.qos, pub.retained, pub.payload, pub.props)
+		if err != nil && (pub.qos > 0 || pub.retained) {
+			slog.Warn("Unable to publish", "topic", pub.topic, "error", err)
+		}
+		if dropped := p.dropped.Swap(0); dropped > 0 {
+			slog.Warn("Publish queue was full, dropped messages", "count", dropped)
+		}
+	}
+}
+
+// Disconnect sends what is still queued, for a while, before disconnecting.
+func (p *publisher) Disconnect() {
+	p.mutex.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mutex.Unlock()
+
+	select {
+	case <-p.done:
+	case <-time.After(publishDrainLimit):
+		slog.Warn("Disconnecting with messages still queued")
+	}
+	p.mqttClient.Disconnect()
+}
@@ -0,0 +1,95 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type Slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Price float64   `json:"price"`
+}
+
+// ParsePrices reads a JSON array of {"start": ..., "price": ...} objects.
+// Slots without an end are assumed to last one hour.
+func ParsePrices(payload []byte) ([]Slot, error) {
+	var slots []Slot
+	if err := json.Unmarshal(payload, &slots); err != nil {
+		return nil, err
+	}
+	for i := range slots {
+		if slots[i].Start.IsZero() {
+			return nil, fmt.Errorf("price slot %d has no start", i)
+		}
+		if slots[i].End.IsZero() {
+			slots[i].End = slots[i].Start.Add(time.Hour)
+		}
+	}
+	return slots, nil
+}
+
+// Plan picks the cheapest slots between now and departure that together
+// deliver energy Wh when charging at power W. Slots are returned in
+// chronological order. It reports false, with no slots, when there is
+// nothing to charge, when the prices do not reach now or when they do not
+// cover enough time to deliver the energy; charging should not wait for a
+// plan it cannot follow.
+func Plan(prices []Slot, now, departure time.Time, energy, power float64) ([]Slot, bool) {
+	if energy <= 0 || power <= 0 {
+		return nil, false
+	}
+
+	current := false
+	var candidates []Slot
+	for _, slot := range prices {
+		if !slot.End.After(now) || !slot.Start.Before(departure) {
+			continue
+		}
+		if !slot.Start.After(now) {
+			current = true
+			slot.Start = now
+		}
+		if slot.End.After(departure) {
+			slot.End = departure
+		}
+		candidates = append(candidates, slot)
+	}
+	if !current {
+		return nil, false
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Price != candidates[j].Price {
+			return candidates[i].Price < candidates[j].Price
+		}
+		return candidates[i].Start.Before(candidates[j].Start)
+	})
+
+	var plan []Slot
+	for _, slot := range candidates {
+		if energy <= 0 {
+			break
+		}
+		plan = append(plan, slot)
+		energy -= power * slot.End.Sub(slot.Start).Hours()
+	}
+	if energy > 0 {
+		return nil, false
+	}
+
+	sort.Slice(plan, func(i, j int) bool { return plan[i].Start.Before(plan[j].Start) })
+	return plan, true
+}
+
+// Active reports whether t falls within one of the planned slots.
+func Active(plan []Slot, t time.Time) bool {
+	for _, slot := range plan {
+		if !t.Before(slot.Start) && t.Before(slot.End) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlan(t *testing.T) {
+	base := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h, m int) time.Time { return base.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute) }
+	hourly := func(from int, prices ...float64) []Slot {
+		slots := make([]Slot, len(prices))
+		for i, price := range prices {
+			slots[i] = Slot{Start: at(from+i, 0), End: at(from+i+1, 0), Price: price}
+		}
+		return slots
+	}
+
+	tests := []struct {
+		name      string
+		prices    []Slot
+		now       time.Time
+		departure time.Time
+		energy    float64
+		wantOK    bool
+		want      []Slot
+		active    []time.Time
+		inactive  []time.Time
+	}{
+		{
+			name:      "cheapest hours",
+			prices:    hourly(0, 3, 1, 2, 4),
+			now:       at(0, 0),
+			departure: at(4, 0),
+			energy:    2000,
+			wantOK:    true,
+			want:      []Slot{{Start: at(1, 0), End: at(2, 0), Price: 1}, {Start: at(2, 0), End: at(3, 0), Price: 2}},
+			active:    []time.Time{at(1, 0), at(2, 59)},
+			inactive:  []time.Time{at(0, 30), at(3, 0)},
+		},
+		{
+			name:      "partial current slot",
+			prices:    hourly(0, 1, 5, 2),
+			now:       at(0, 30),
+			departure: at(3, 0),
+			energy:    1000,
+			wantOK:    true,
+			want:      []Slot{{Start: at(0, 30), End: at(1, 0), Price: 1}, {Start: at(2, 0), End: at(3, 0), Price: 2}},
+			active:    []time.Time{at(0, 30), at(2, 0)},
+			inactive:  []time.Time{at(1, 0), at(3, 0)},
+		},
+		{
+			name:      "slot cut at departure",
+			prices:    hourly(0, 5, 1),
+			now:       at(0, 0),
+			departure: at(1, 30),
+			energy:    500,
+			wantOK:    true,
+			want:      []Slot{{Start: at(1, 0), End: at(1, 30), Price: 1}},
+			active:    []time.Time{at(1, 0)},
+			inactive:  []time.Time{at(0, 0), at(1, 30)},
+		},
+		{
+			name:      "stale prices",
+			prices:    hourly(0, 1, 2, 3),
+			now:       at(24, 0),
+			departure: at(31, 0),
+			energy:    1000,
+			inactive:  []time.Time{at(24, 0)},
+		},
+		{
+			name:      "prices start after now",
+			prices:    hourly(2, 1, 2),
+			now:       at(0, 0),
+			departure: at(7, 0),
+			energy:    1000,
+		},
+		{
+			name:      "prices end before departure",
+			prices:    hourly(0, 1, 2),
+			now:       at(0, 0),
+			departure: at(7, 0),
+			energy:    3000,
+		},
+		{
+			name:      "nothing to charge",
+			prices:    hourly(0, 1, 2),
+			now:       at(0, 0),
+			departure: at(2, 0),
+			energy:    0,
+		},
+		{
+			name:      "already charged",
+			prices:    hourly(0, 1, 2),
+			now:       at(0, 0),
+			departure: at(2, 0),
+			energy:    -500,
+		},
+		{
+			name:      "no prices",
+			now:       at(0, 0),
+			departure: at(2, 0),
+			energy:    1000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, ok := Plan(tt.prices, tt.now, tt.departure, tt.energy, 1000)
+			if ok != tt.wantOK {
+				t.Fatalf("Plan() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if len(plan) != len(tt.want) {
+				t.Fatalf("Plan() = %v, want %v", plan, tt.want)
+			}
+			for i := range plan {
+				if !plan[i].Start.Equal(tt.want[i].Start) || !plan[i].End.Equal(tt.want[i].End) || plan[i].Price != tt.want[i].Price {
+					t.Errorf("Plan()[%d] = %v, want %v", i, plan[i], tt.want[i])
+				}
+			}
+			for _, ts := range tt.active {
+				if !Active(plan, ts) {
+					t.Errorf("Active(%s) = false, want true", ts.Format(time.Kitchen))
+				}
+			}
+			for _, ts := range tt.inactive {
+				if Active(plan, ts) {
+					t.Errorf("Active(%s) = true, want false", ts.Format(time.Kitchen))
+				}
+			}
+		})
+	}
+}
@@ -2,16 +2,58 @@ package bridge
 
 import (
 	"fmt"
+	"log/slog"
+	"slices"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/wallbox"
 )
 
 type Entity struct {
 	Component string
-	Getter    func() string
-	Setter    func(string)
-	Config    map[string]string
+	// Source is where the value is read from, empty for values the bridge
+	// works out itself.
+	Source     string
+	Getter     func() string
+	Setter     func(string) error
+	Attributes func() map[string]interface{}
+	Config     map[string]interface{}
+}
+
+const (
+	sourceRedis  = "redis"
+	sourceMySQL  = "mysql"
+	sourceBridge = "bridge"
+)
+
+func (e Entity) source() string {
+	if e.Source == "" {
+		return sourceBridge
+	}
+	return e.Source
+}
+
+const restartConfirmWindow = 10 * time.Second
+
+// confirmed wraps action so that it only runs when pressed twice within
+// window, guarding against accidental presses.
+func confirmed(name string, window time.Duration, action func() error) func(string) error {
+	var mutex sync.Mutex
+	var armedAt time.Time
+	return func(string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if time.Since(armedAt) > window {
+			armedAt = time.Now()
+			slog.Warn("Press again to confirm", "action", name, "within", window)
+			return nil
+		}
+		armedAt = time.Time{}
+		slog.Warn("Confirmed", "action", name)
+		return action()
+	}
 }
 
 func strToInt(val string) int {
@@ -28,8 +70,9 @@ func getEntities(w *wallbox.Wallbox) map[string]Entity {
 	return map[string]Entity{
 		"added_energy": {
 			Component: "sensor",
-			Getter:    func() string { return fmt.Sprint(w.Data.RedisState.ScheduleEnergy) },
-			Config: map[string]string{
+			Source:    sourceRedis,
+			Getter:    func() string { return fmt.Sprint(w.Data().RedisState.ScheduleEnergy) },
+			Config: map[string]interface{}{
 				"name":                        "Added energy",
 				"device_class":                "energy",
 				"unit_of_measurement":         "Wh",
@@ -39,8 +82,9 @@ func getEntities(w *wallbox.Wallbox) map[string]Entity {
 		},
 		"added_range": {
 			Component: "sensor",
-			Getter:    func() string { return fmt.Sprint(w.Data.SQL.AddedRange) },
-			Config: map[string]string{
+			Source:    sourceMySQL,
+			Getter:    func() string { return fmt.Sprint(w.Data().SQL.AddedRange) },
+			Config: map[string]interface{}{
 				"name":                        "Added range",
 				"device_class":                "distance",
 				"unit_of_measurement":         "km",
@@ -51,8 +95,9 @@ func getEntities(w *wallbox.Wallbox) map[string]Entity {
 		},
 		"cable_connected": {
 			Component: "binary_sensor",
+			Source:    sourceRedis,
 			Getter:    func() string { return strconv.Itoa(w.CableConnected()) },
-			Config: map[string]string{
+			Config: map[string]interface{}{
 				"name":         "Cable connected",
 				"payload_on":   "1",
 				"payload_off":  "0",
@@ -62,9 +107,10 @@ func getEntities(w *wallbox.Wallbox) map[string]Entity {
 		},
 		"charging_enable": {
 			Component: "switch",
-			Setter:    func(val string) { w.SetChargingEnable(strToInt(val)) },
-			Getter:    func() string { return strconv.Itoa(w.Data.SQL.ChargingEnable) },
-			Config: map[string]string{
+			Source:    sourceMySQL,
+			Setter:    func(val string) error { return w.SetChargingEnable(strToInt(val)) },
+			Getter:    func() string { return strconv.Itoa(w.Data().SQL.ChargingEnable) },
+			Config: map[string]interface{}{
 				"name":        "Charging enable",
 				"payload_on":  "1",
 				"payload_off": "0",
@@ -73,10 +119,12 @@ func getEntities(w *wallbox.Wallbox) map[string]Entity {
 		},
 		"charging_power": {
 			Component: "sensor",
+			Source:    sourceRedis,
 			Getter: func() string {
-				return fmt.Sprint(w.Data.RedisM2W.Line1Power + w.Data.RedisM2W.Line2Power + w.Data.RedisM2W.Line3Power)
+				m2w := w.Data().RedisM2W
+				return fmt.Sprint(m2w.Line1Power + m2w.Line2Power + m2w.Line3Power)
 			},
-			Config: map[string]string{
+			Config: map[string]interface{}{
 				"name":                        "Charging power",
 				"device_class":                "power",
 				"unit_of_measurement":         "W",
@@ -86,8 +134,9 @@ func getEntities(w *wallbox.Wallbox) map[string]Entity {
 		},
 		"cumulative_added_energy": {
 			Component: "sensor",
-			Getter:    func() string { return fmt.Sprint(w.Data.SQL.CumulativeAddedEnergy) },
-			Config: map[string]string{
+			Source:    sourceMySQL,
+			Getter:    func() string { return fmt.Sprint(w.Data().SQL.CumulativeAddedEnergy) },
+			Config: map[string]interface{}{
 				"name":                        "Cumulative added energy",
 				"device_class":                "energy",
 				"unit_of_measurement":         "Wh",
@@ -95,11 +144,23 @@ func getEntities(w *wallbox.Wallbox) map[string]Entity {
 				"suggested_display_precision": "1",
 			},
 		},
+		"eco_smart_waiting": {
+			Component: "binary_sensor",
+			Source:    sourceRedis,
+			Getter:    func() string { return strconv.Itoa(w.WaitingForEcoPower()) },
+			Config: map[string]interface{}{
+				"name":        "Waiting for eco power",
+				"payload_on":  "1",
+				"payload_off": "0",
+				"icon":        "mdi:solar-power-variant",
+			},
+		},
 		"halo_brightness": {
 			Component: "number",
-			Setter:    func(val string) { w.SetHaloBrightness(strToInt(val)) },
-			Getter:    func() string { return strconv.Itoa(w.Data.SQL.HaloBrightness) },
-			Config: map[string]string{
+			Source:    sourceMySQL,
+			Setter:    func(val string) error { return w.SetHaloBrightness(strToInt(val)) },
+			Getter:    func() string { return strconv.Itoa(w.Data().SQL.HaloBrightness) },
+			Config: map[string]interface{}{
 				"name":                "Halo Brightness",
 				"command_topic":       "~/set",
 				"min":                 "0",
@@ -111,9 +172,10 @@ func getEntities(w *wallbox.Wallbox) map[string]Entity {
 		},
 		"lock": {
 			Component: "lock",
-			Setter:    func(val string) { w.SetLocked(strToInt(val)) },
-			Getter:    func() string { return strconv.Itoa(w.Data.SQL.Lock) },
-			Config: map[string]string{
+			Source:    sourceMySQL,
+			Setter:    func(val string) error { return w.SetLocked(strToInt(val)) },
+			Getter:    func() string { return strconv.Itoa(w.Data().SQL.Lock) },
+			Config: map[string]interface{}{
 				"name":           "Lock",
 				"payload_lock":   "1",
 				"payload_unlock": "0",
@@ -124,9 +186,10 @@ func getEntities(w *wallbox.Wallbox) map[string]Entity {
 		},
 		"max_charging_current": {
 			Component: "number",
-			Setter:    func(val string) { w.SetMaxChargingCurrent(strToInt(val)) },
-			Getter:    func() string { return strconv.Itoa(w.Data.SQL.MaxChargingCurrent) },
-			Config: map[string]string{
+			Source:    sourceMySQL,
+			Setter:    func(val string) error { return w.SetMaxChargingCurrent(strToInt(val)) },
+			Getter:    func() string { return strconv.Itoa(w.Data().SQL.MaxChargingCurrent) },
+			Config: map[string]interface{}{
 				"name":                "Max charging current",
 				"command_topic":       "~/set",
 				"min":                 "6",
@@ -135,43 +198,225 @@ func getEntities(w *wallbox.Wallbox) map[string]Entity {
 				"device_class":        "current",
 			},
 		},
+		"pause": {
+			Component: "button",
+			Setter:    func(string) error { return w.Pause() },
+			Config: map[string]interface{}{
+				"name": "Pause",
+				"icon": "mdi:pause",
+			},
+		},
+		"restart": {
+			Component: "button",
+			Setter:    confirmed("restart", restartConfirmWindow, w.Restart),
+			Config: map[string]interface{}{
+				"name":            "Restart (press twice)",
+				"device_class":    "restart",
+				"entity_category": "config",
+			},
+		},
+		"resume": {
+			Component: "button",
+			Setter:    func(string) error { return w.Resume() },
+			Config: map[string]interface{}{
+				"name": "Resume",
+				"icon": "mdi:play",
+			},
+		},
 		"status": {
 			Component: "sensor",
+			Source:    sourceRedis,
 			Getter:    w.EffectiveStatus,
-			Config: map[string]string{
+			Config: map[string]interface{}{
 				"name": "Status",
 			},
 		},
 	}
 }
 
+func getPowerBoostEntities(w *wallbox.Wallbox) map[string]Entity {
+	return map[string]Entity{
+		"power_boost_enable": {
+			Component: "switch",
+			Source:    sourceMySQL,
+			Setter:    func(val string) error { return w.SetPowerBoostEnable(strToInt(val)) },
+			Getter:    func() string { return strconv.Itoa(w.Data().SQL.PowerBoostEnable) },
+			Config: map[string]interface{}{
+				"name":            "Power Boost",
+				"payload_on":      "1",
+				"payload_off":     "0",
+				"icon":            "mdi:home-lightning-bolt",
+				"entity_category": "config",
+			},
+		},
+		"power_boost_max_current": {
+			Component: "number",
+			Source:    sourceMySQL,
+			Setter:    func(val string) error { return w.SetPowerBoostMaxCurrent(strToInt(val)) },
+			Getter:    func() string { return strconv.Itoa(w.Data().SQL.PowerBoostMaxCurrent) },
+			Config: map[string]interface{}{
+				"name":                "Power Boost max current",
+				"min":                 "6",
+				"max":                 "100",
+				"unit_of_measurement": "A",
+				"device_class":        "current",
+				"entity_category":     "config",
+			},
+		},
+	}
+}
+
+func getPowerSharingEntities(w *wallbox.Wallbox) map[string]Entity {
+	return map[string]Entity{
+		"power_sharing_max_current": {
+			Component: "number",
+			Source:    sourceMySQL,
+			Setter:    func(val string) error { return w.SetPowerSharingMaxCurrent(strToInt(val)) },
+			Getter:    func() string { return strconv.Itoa(w.Data().SQL.PowerSharingCurrent) },
+			Config: map[string]interface{}{
+				"name":                "Power sharing max current",
+				"min":                 "6",
+				"max":                 "100",
+				"unit_of_measurement": "A",
+				"device_class":        "current",
+				"entity_category":     "config",
+			},
+		},
+		"power_sharing_mode": {
+			Component: "select",
+			Source:    sourceMySQL,
+			Setter:    w.SetPowerSharingMode,
+			Getter:    w.PowerSharingMode,
+			Config: map[string]interface{}{
+				"name":            "Power sharing mode",
+				"options":         wallbox.PowerSharingModes,
+				"icon":            "mdi:transmission-tower",
+				"entity_category": "config",
+			},
+		},
+	}
+}
+
+func getEcoSmartEntities(w *wallbox.Wallbox) map[string]Entity {
+	return map[string]Entity{
+		"eco_smart_mode": {
+			Component: "select",
+			Source:    sourceMySQL,
+			Setter:    w.SetEcoSmartMode,
+			Getter:    w.EcoSmartMode,
+			Config: map[string]interface{}{
+				"name":            "Eco-Smart mode",
+				"options":         wallbox.EcoSmartModes,
+				"icon":            "mdi:solar-power",
+				"entity_category": "config",
+			},
+		},
+		"eco_smart_percentage": {
+			Component: "number",
+			Source:    sourceMySQL,
+			Setter:    func(val string) error { return w.SetEcoSmartPercentage(strToInt(val)) },
+			Getter:    func() string { return strconv.Itoa(w.Data().SQL.EcoSmartPercentage) },
+			Config: map[string]interface{}{
+				"name":                "Eco-Smart percentage",
+				"min":                 "0",
+				"max":                 "100",
+				"unit_of_measurement": "%",
+				"icon":                "mdi:solar-power",
+				"entity_category":     "config",
+			},
+		},
+	}
+}
+
+// getUserEntities lists the charger's users. The unlock options are the
+// users when the entities are built, the charger rebuilds them when the
+// users change.
+func getUserEntities(w *wallbox.Wallbox) map[string]Entity {
+	users := w.Data().Users
+	if users == nil {
+		users = []wallbox.User{}
+	}
+	options := []string{wallbox.NoUser}
+	for _, user := range users {
+		options = append(options, user.Label())
+	}
+	// Home Assistant rejects a state that is not one of the options, like
+	// the built-in user or one added since.
+	sessionUserLabel := func() string {
+		if label := w.SessionUserLabel(); slices.Contains(options, label) {
+			return label
+		}
+		return wallbox.NoUser
+	}
+
+	return map[string]Entity{
+		"session_user": {
+			Component: "sensor",
+			Source:    sourceMySQL,
+			Getter:    w.SessionUser,
+			Config: map[string]interface{}{
+				"name": "Session user",
+				"icon": "mdi:card-account-details",
+			},
+		},
+		"unlock_user": {
+			Component: "select",
+			Source:    sourceMySQL,
+			Setter:    w.UnlockAs,
+			Getter:    sessionUserLabel,
+			Config: map[string]interface{}{
+				"name":    "Unlock as user",
+				"options": options,
+				"icon":    "mdi:account-key",
+			},
+		},
+		"users": {
+			Component: "sensor",
+			Source:    sourceMySQL,
+			Getter:    func() string { return strconv.Itoa(len(users)) },
+			Attributes: func() map[string]interface{} {
+				return map[string]interface{}{"users": users}
+			},
+			Config: map[string]interface{}{
+				"name":            "Users",
+				"icon":            "mdi:account-group",
+				"entity_category": "diagnostic",
+			},
+		},
+	}
+}
+
 func getDebugEntities(w *wallbox.Wallbox) map[string]Entity {
 	return map[string]Entity{
 		"control_pilot": {
 			Component: "sensor",
+			Source:    sourceRedis,
 			Getter:    w.ControlPilotStatus,
-			Config: map[string]string{
+			Config: map[string]interface{}{
 				"name": "Control pilot",
 			},
 		},
 		"m2w_status": {
 			Component: "sensor",
-			Getter:    func() string { return fmt.Sprint(w.Data.RedisM2W.ChargerStatus) },
-			Config: map[string]string{
+			Source:    sourceRedis,
+			Getter:    func() string { return fmt.Sprint(w.Data().RedisM2W.ChargerStatus) },
+			Config: map[string]interface{}{
 				"name": "M2W Status",
 			},
 		},
 		"state_machine_state": {
 			Component: "sensor",
+			Source:    sourceRedis,
 			Getter:    w.StateMachineState,
-			Config: map[string]string{
+			Config: map[string]interface{}{
 				"name": "State machine",
 			},
 		},
 		"s2_open": {
 			Component: "sensor",
-			Getter:    func() string { return strconv.Itoa(w.Data.RedisState.S2open) },
-			Config: map[string]string{
+			Source:    sourceRedis,
+			Getter:    func() string { return strconv.Itoa(w.Data().RedisState.S2open) },
+			Config: map[string]interface{}{
 				"name": "S2 open",
 			},
 		},
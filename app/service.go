@@ -0,0 +1,180 @@
+package bridge
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/wallbox"
+)
+
+const (
+	serviceName       = "mqtt-bridge"
+	serviceUnitPath   = "/lib/systemd/system/mqtt-bridge.service"
+	defaultConfigPath = "/home/root/mqtt-bridge/bridge.ini"
+)
+
+var service = `[Unit]
+Description=MQTT Bridge
+After=network.target
+Requires=mysqld.service
+StartLimitIntervalSec=0
+
+[Service]
+Type=simple
+Restart=always
+RestartSec=1
+User=root
+ExecStart=/home/root/mqtt-bridge/bridge %s
+ExecReload=/bin/kill -HUP $MAINPID
+
+[Install]
+WantedBy=multi-user.target
+`
+
+func installService(configPath string) {
+	os.WriteFile(serviceUnitPath, []byte(fmt.Sprintf(service, configPath)), 0644)
+	var cmd *exec.Cmd
+	cmd = exec.Command("systemctl", "daemon-reload")
+	cmd.Run()
+	cmd = exec.Command("systemctl", "enable", serviceName)
+	cmd.Run()
+	cmd = exec.Command("systemctl", "restart", serviceName)
+	cmd.Run()
+}
+
+// serviceConfigPath returns the config file passed to the bridge in the
+// installed unit, falling back to the default location.
+func serviceConfigPath() string {
+	file, err := os.Open(serviceUnitPath)
+	if err != nil {
+		return defaultConfigPath
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "ExecStart=") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "ExecStart="))
+		if len(fields) == 2 {
+			return fields[1]
+		}
+	}
+	return defaultConfigPath
+}
+
+func systemctlOutput(args ...string) string {
+	out, _ := exec.Command("systemctl", args...).Output()
+	return strings.TrimSpace(string(out))
+}
+
+// purgeDiscovery clears every retained topic the bridge may have published
+// so that the device disappears from Home Assistant.
+func purgeDiscovery(c *WallboxConfig) error {
+	client, err := connectMQTT(c.toolConfig(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect()
+
+	// Enable every optional entity so that all of them are removed.
+	everything := *c
+	everything.Settings.DebugSensors = true
+	everything.Cost.Price = 1
+	everything.SmartCharging.PriceTopic = "-"
+	everything.Site.MaxCurrent = 1
+
+	chargers := c.chargerConfigs()
+	for i, cc := range chargers {
+		w, err := wallbox.Connect(cc.Wallbox.wallboxConfig())
+		if err != nil {
+			return err
+		}
+		serialNumber := w.SerialNumber()
+		entityConfig := getAllEntities(w, &everything, newDiagnostics(&atomic.Int64{}), &energyLimit{}, &costTracker{}, &smartCharging{}, &siteController{}, cc.Name)
+		for key, val := range entityConfig {
+			removeDiscovery(client, byte(c.MQTT.QoSDiscovery), serialNumber, key, val)
+		}
+		client.Publish("wallbox_"+serialNumber+"/availability", byte(c.MQTT.QoSAvailability), true, nil, nil)
+		client.Publish("wallbox_"+serialNumber+"/state", byte(c.MQTT.QoSState), true, nil, nil)
+		if i == 0 && len(chargers) > 1 {
+			client.Publish("wallbox_"+serialNumber+"/bridge_availability", byte(c.MQTT.QoSAvailability), true, nil, nil)
+		}
+		w.Close()
+	}
+	return nil
+}
+
+func RunUninstall(purge bool) {
+	// Stop the bridge first, or it republishes its availability on the way
+	// out and undoes the purge.
+	exec.Command("systemctl", "stop", serviceName).Run()
+	exec.Command("systemctl", "disable", serviceName).Run()
+
+	if purge {
+		configPath := serviceConfigPath()
+		c, _, err := loadConfig(configPath)
+		if err != nil {
+			fmt.Println("Unable to purge Home Assistant discovery:", err)
+		} else if err := purgeDiscovery(c); err != nil {
+			fmt.Println("Unable to purge Home Assistant discovery:", err)
+		} else {
+			fmt.Println("Purged Home Assistant discovery topics")
+		}
+	}
+
+	if err := os.Remove(serviceUnitPath); err != nil && !os.IsNotExist(err) {
+		fmt.Println("Unable to remove service:", err)
+		os.Exit(1)
+	}
+	exec.Command("systemctl", "daemon-reload").Run()
+	os.Remove(statusPath)
+	fmt.Println("Uninstalled", serviceName)
+}
+
+func RunStatus() {
+	fmt.Println("Version:      ", Version)
+	fmt.Printf("Service:       %s (%s)\n", systemctlOutput("is-active", serviceName), systemctlOutput("is-enabled", serviceName))
+	fmt.Println("Config:       ", serviceConfigPath())
+
+	// The status file outlives a crashed bridge.
+	status, err := readStatus()
+	if err != nil || !processAlive(status.PID) {
+		fmt.Println("Bridge:        not running")
+		return
+	}
+
+	connected := "disconnected"
+	if status.MQTTConnected {
+		connected = "connected"
+	}
+	fmt.Printf("Bridge:        %s, pid %d, up %s\n", status.Version, status.PID, time.Since(status.StartedAt).Round(time.Second))
+	fmt.Println("MQTT:         ", connected)
+	if status.LastPoll.IsZero() {
+		fmt.Println("Last poll:     never")
+	} else {
+		fmt.Printf("Last poll:     %s (%s ago)\n", status.LastPoll.Format(time.RFC3339), time.Since(status.LastPoll).Round(time.Second))
+	}
+}
+
+func RunLogs(args []string) {
+	journalArgs := []string{"-u", serviceName, "--no-pager"}
+	if len(args) == 0 {
+		args = []string{"-n", "100", "-f"}
+	}
+	cmd := exec.Command("journalctl", append(journalArgs, args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,142 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/wallbox"
+)
+
+const dateLayout = "2006-01-02"
+
+type exportRequest struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Format string `json:"format"`
+}
+
+// parseRange turns inclusive YYYY-MM-DD dates into a [from, to) range. The
+// defaults cover the current month.
+func (r exportRequest) parseRange(now time.Time) (time.Time, time.Time, error) {
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 1, 0)
+	var err error
+	if r.From != "" {
+		if from, err = time.ParseInLocation(dateLayout, r.From, time.Local); err != nil {
+			return from, to, fmt.Errorf("invalid from date %q, expected YYYY-MM-DD", r.From)
+		}
+	}
+	if r.To != "" {
+		if to, err = time.ParseInLocation(dateLayout, r.To, time.Local); err != nil {
+			return from, to, fmt.Errorf("invalid to date %q, expected YYYY-MM-DD", r.To)
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	return from, to, nil
+}
+
+func writeSessions(out io.Writer, sessions []wallbox.Session, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(sessions)
+	case "csv":
+		writer := csv.NewWriter(out)
+		writer.Write([]string{"id", "start", "end", "energy_wh", "range_km", "user_id", "user"})
+		for _, s := range sessions {
+			writer.Write([]string{
+				strconv.FormatInt(s.ID, 10),
+				s.Start.Format(time.RFC3339),
+				s.End.Format(time.RFC3339),
+				strconv.FormatFloat(s.Energy, 'f', -1, 64),
+				strconv.FormatFloat(s.Range, 'f', -1, 64),
+				strconv.FormatInt(s.UserID, 10),
+				s.User,
+			})
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	return fmt.Errorf("unknown format %q, expected csv or json", format)
+}
+
+func exportSessions(w *wallbox.Wallbox, out io.Writer, request exportRequest) error {
+	from, to, err := request.parseRange(time.Now())
+	if err != nil {
+		return err
+	}
+	sessions, err := w.Sessions(from, to)
+	if err != nil {
+		return err
+	}
+	return writeSessions(out, sessions, request.Format)
+}
+
+func RunSessionsExport(args []string) {
+	var request exportRequest
+	var configPath, chargerName string
+	flags := flag.NewFlagSet("sessions export", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", serviceConfigPath(), "bridge.ini to read the [wallbox] settings from")
+	flags.StringVar(&chargerName, "charger", "", "name of the [charger.<name>] section to export (default: the first charger)")
+	flags.StringVar(&request.From, "from", "", "first day to export, YYYY-MM-DD (default: start of this month)")
+	flags.StringVar(&request.To, "to", "", "last day to export, YYYY-MM-DD (default: end of this month)")
+	flags.StringVar(&request.Format, "format", "csv", "csv or json")
+	flags.Parse(args)
+
+	c := loadConfigOrDefaults(configPath)
+	cc := c.chargerConfigs()[0]
+	if chargerName != "" {
+		var ok bool
+		if cc, ok = c.chargerConfig(chargerName); !ok {
+			fmt.Fprintf(os.Stderr, "no [charger.%s] section in %s\n", chargerName, configPath)
+			os.Exit(1)
+		}
+	}
+
+	w, err := wallbox.Connect(cc.Wallbox.wallboxConfig())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer w.Close()
+
+	if err := exportSessions(w, os.Stdout, request); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// sessionsExportHandler answers JSON export requests such as
+// {"from": "2024-01-01", "to": "2024-01-31", "format": "csv"} on the
+// export topic by publishing the report to <topic>/result, or to the
+// request's MQTT 5 response topic.
+func sessionsExportHandler(w *wallbox.Wallbox, qos byte) messageHandler {
+	return func(client mqttClient, msg *message) {
+		request := exportRequest{Format: "json"}
+		if len(msg.Payload) > 0 {
+			if err := json.Unmarshal(msg.Payload, &request); err != nil {
+				slog.Warn("Ignoring invalid sessions export request", "error", err)
+				return
+			}
+		}
+
+		var report bytes.Buffer
+		if err := exportSessions(w, &report, request); err != nil {
+			slog.Error("Unable to export sessions", "error", err)
+			report.Reset()
+			json.NewEncoder(&report).Encode(map[string]string{"error": err.Error()})
+		} else {
+			slog.Info("Exported sessions", "from", request.From, "to", request.To, "format", request.Format)
+		}
+		respond(client, qos, msg, msg.Topic+"/result", report.Bytes())
+	}
+}
@@ -0,0 +1,359 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	siteStrategyEqual     = "equal"
+	siteStrategyPriority  = "priority"
+	siteStrategyFirstCome = "first_come"
+)
+
+var siteStrategies = map[string]bool{
+	siteStrategyEqual:     true,
+	siteStrategyPriority:  true,
+	siteStrategyFirstCome: true,
+}
+
+// siteController divides the site's total current among the chargers that
+// have a car wanting current. Each charger reports its state after every
+// poll, and the shares of all chargers are then worked out and applied here,
+// lowering currents before raising others so that the site maximum holds
+// throughout. A car connecting, finishing or leaving is rebalanced within one
+// polling interval.
+type siteController struct {
+	mutex      sync.Mutex
+	maxCurrent int
+	minCurrent int
+	strategy   string
+	statePath  string
+	chargers   []*siteCharger
+
+	// UserCurrents are the chargers' own max charging currents from before
+	// the site took over, restored when power sharing is turned off.
+	UserCurrents map[string]int `json:"user_currents"`
+}
+
+type siteCharger struct {
+	name      string
+	priority  int
+	active    bool
+	since     time.Time
+	limit     int
+	allocated int
+	// reported is set once the charger has reported since power sharing
+	// was turned on, its current is not touched before then.
+	reported bool
+	// applied is the share last applied, -1 when unknown.
+	applied int
+	// apply sets the charger's max charging current, zero pauses it.
+	apply func(current int) error
+}
+
+func siteStatePath(configPath string) string {
+	return strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".site.json"
+}
+
+func newSiteController(c *WallboxConfig, statePath string) *siteController {
+	s := &siteController{statePath: statePath, UserCurrents: map[string]int{}}
+	if data, err := os.ReadFile(statePath); err == nil {
+		if err := json.Unmarshal(data, s); err != nil {
+			slog.Warn("Ignoring unreadable site state", "path", statePath, "error", err)
+		}
+	}
+	if s.UserCurrents == nil {
+		s.UserCurrents = map[string]int{}
+	}
+	s.configure(c)
+	return s
+}
+
+func (s *siteController) configure(c *WallboxConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	wasEnabled := s.maxCurrent > 0
+	s.maxCurrent = c.Site.MaxCurrent
+	s.minCurrent = c.Site.MinCurrent
+	s.strategy = c.Site.Strategy
+
+	previous := map[string]*siteCharger{}
+	for _, sc := range s.chargers {
+		previous[sc.name] = sc
+	}
+	s.chargers = nil
+	for _, cc := range c.chargerConfigs() {
+		sc, ok := previous[cc.Name]
+		if !ok {
+			sc = &siteCharger{name: cc.Name, applied: -1}
+		}
+		sc.priority = cc.Priority
+		s.chargers = append(s.chargers, sc)
+	}
+
+	if wasEnabled && s.maxCurrent <= 0 {
+		for _, sc := range s.chargers {
+			s.restore(sc)
+		}
+		return
+	}
+	if s.maxCurrent > 0 {
+		s.balance()
+	}
+}
+
+// attach registers how to apply a charger's share. A charger whose current
+// is still the site's from an earlier run gets its own back when power
+// sharing has been turned off since.
+func (s *siteController) attach(name string, apply func(current int) error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sc := s.find(name)
+	if sc == nil {
+		return
+	}
+	sc.apply = apply
+	if s.maxCurrent <= 0 {
+		s.restore(sc)
+	}
+}
+
+func (s *siteController) enabled() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.maxCurrent > 0
+}
+
+func (s *siteController) find(name string) *siteCharger {
+	for _, sc := range s.chargers {
+		if sc.name == name {
+			return sc
+		}
+	}
+	return nil
+}
+
+// report records whether a charger wants current, its own maximum and its
+// current setting, then rebalances the site. The setting is remembered as
+// the user's the first time.
+func (s *siteController) report(name string, active bool, limit, current int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sc := s.find(name)
+	if sc == nil {
+		return
+	}
+	if s.maxCurrent <= 0 {
+		// Retry a restore that failed when power sharing was turned off.
+		s.restore(sc)
+		return
+	}
+	if _, ok := s.UserCurrents[name]; !ok && current > 0 {
+		s.UserCurrents[name] = current
+		s.save()
+	}
+	if active != sc.active {
+		slog.Info("Rebalancing site current", "charger", name, "active", active)
+		if active {
+			sc.since = time.Now()
+		}
+	}
+	sc.active = active
+	sc.limit = limit
+	sc.reported = true
+	s.balance()
+}
+
+// setUserCurrent changes the user's max charging current, which caps the
+// charger's share while power sharing is on.
+func (s *siteController) setUserCurrent(name string, current int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.maxCurrent <= 0 {
+		return fmt.Errorf("power sharing is off")
+	}
+	if current < s.minCurrent {
+		return fmt.Errorf("max charging current %d is below the site minimum %d", current, s.minCurrent)
+	}
+	s.UserCurrents[name] = current
+	s.save()
+	s.balance()
+	return nil
+}
+
+// restore gives a charger its own max charging current back and lifts a
+// pause, the caller must hold the mutex.
+func (s *siteController) restore(sc *siteCharger) {
+	sc.active = false
+	sc.allocated = 0
+	sc.reported = false
+	current, ok := s.UserCurrents[sc.name]
+	if !ok || sc.apply == nil {
+		return
+	}
+	slog.Info("Power sharing off, restoring max charging current", "charger", sc.name, "max_charging_current", current)
+	if err := sc.apply(current); err != nil {
+		slog.Error("Unable to restore max charging current", "charger", sc.name, "error", err)
+		return
+	}
+	sc.applied = -1
+	delete(s.UserCurrents, sc.name)
+	s.save()
+}
+
+// balance works out every charger's share and applies the changes. When a
+// lower current can not be applied, higher ones wait for the next round.
+// The caller must hold the mutex.
+func (s *siteController) balance() {
+	s.allocate()
+
+	lowered := true
+	for _, sc := range s.chargers {
+		if sc.reported && sc.apply != nil && (sc.applied < 0 || sc.allocated < sc.applied) {
+			lowered = s.apply(sc) && lowered
+		}
+	}
+	if !lowered {
+		return
+	}
+	for _, sc := range s.chargers {
+		if sc.reported && sc.apply != nil && sc.allocated > sc.applied {
+			s.apply(sc)
+		}
+	}
+}
+
+func (s *siteController) apply(sc *siteCharger) bool {
+	slog.Info("Setting site share", "charger", sc.name, "max_charging_current", sc.allocated)
+	if err := sc.apply(sc.allocated); err != nil {
+		slog.Error("Unable to apply site share", "charger", sc.name, "max_charging_current", sc.allocated, "error", err)
+		return false
+	}
+	sc.applied = sc.allocated
+	return true
+}
+
+// allocate recomputes every charger's share, the caller must hold the mutex.
+// Idle chargers keep the minimum, so that a car plugging in can only draw
+// what has been set aside for it. Idle chargers it can not be set aside for
+// are paused.
+func (s *siteController) allocate() {
+	remaining := s.maxCurrent
+	var active []*siteCharger
+	for _, sc := range s.chargers {
+		sc.allocated = 0
+		if sc.active {
+			active = append(active, sc)
+		} else if remaining >= s.minCurrent {
+			sc.allocated = s.minCurrent
+			remaining -= s.minCurrent
+		}
+	}
+
+	switch s.strategy {
+	case siteStrategyPriority:
+		sort.SliceStable(active, func(i, j int) bool { return active[i].priority > active[j].priority })
+	case siteStrategyFirstCome:
+		sort.SliceStable(active, func(i, j int) bool { return active[i].since.Before(active[j].since) })
+	}
+
+	if s.strategy != siteStrategyEqual {
+		for _, sc := range active {
+			sc.allocated = min(remaining, s.capacity(sc))
+			if sc.allocated < s.minCurrent {
+				sc.allocated = 0
+			}
+			remaining -= sc.allocated
+		}
+		return
+	}
+
+	// Serve as many chargers as can get the minimum, then share equally,
+	// handing what a charger can not use on to the others.
+	if served := remaining / s.minCurrent; served < len(active) {
+		active = active[:served]
+	}
+	sort.SliceStable(active, func(i, j int) bool { return s.capacity(active[i]) < s.capacity(active[j]) })
+	for i, sc := range active {
+		sc.allocated = min(remaining/(len(active)-i), s.capacity(sc))
+		remaining -= sc.allocated
+	}
+}
+
+func (s *siteController) save() {
+	data, _ := json.Marshal(s)
+	tmpPath := s.statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		slog.Warn("Unable to save site state", "error", err)
+		return
+	}
+	if err := os.Rename(tmpPath, s.statePath); err != nil {
+		slog.Warn("Unable to save site state", "error", err)
+	}
+}
+
+// capacity is the most a charger can take, capped by its user's max
+// charging current.
+func (s *siteController) capacity(sc *siteCharger) int {
+	capacity := s.maxCurrent
+	if sc.limit > 0 {
+		capacity = min(capacity, sc.limit)
+	}
+	if user := s.UserCurrents[sc.name]; user > 0 {
+		capacity = min(capacity, user)
+	}
+	return capacity
+}
+
+func (s *siteController) allocation(name string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if sc := s.find(name); sc != nil {
+		return strconv.Itoa(sc.allocated)
+	}
+	return "0"
+}
+
+func (s *siteController) attributes(name string) map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	active := 0
+	for _, sc := range s.chargers {
+		if sc.active {
+			active++
+		}
+	}
+	sc := s.find(name)
+	return map[string]interface{}{
+		"strategy":         s.strategy,
+		"site_max_current": s.maxCurrent,
+		"active_chargers":  active,
+		"waiting":          sc != nil && sc.active && sc.allocated == 0,
+	}
+}
+
+func getSiteEntities(s *siteController, name string) map[string]Entity {
+	return map[string]Entity{
+		"site_allocated_current": {
+			Component:  "sensor",
+			Getter:     func() string { return s.allocation(name) },
+			Attributes: func() map[string]interface{} { return s.attributes(name) },
+			Config: map[string]interface{}{
+				"name":                "Site allocated current",
+				"device_class":        "current",
+				"unit_of_measurement": "A",
+				"state_class":         "measurement",
+				"icon":                "mdi:transmission-tower",
+			},
+		},
+	}
+}
@@ -0,0 +1,222 @@
+package bridge
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/scheduler"
+	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/wallbox"
+)
+
+var departurePattern = regexp.MustCompile(`^([01]\d|2[0-3]):[0-5]\d$`)
+
+// smartCharging plans the cheapest hours to add the requested energy before
+// departure and pauses or resumes charging to follow the plan.
+type smartCharging struct {
+	mutex      sync.Mutex
+	priceTopic string
+	power      float64
+	prices     []scheduler.Slot
+
+	enabled   bool
+	departure string
+	energy    float64
+
+	plan    []scheduler.Slot
+	waiting bool
+}
+
+func newSmartCharging(c *WallboxConfig) *smartCharging {
+	s := &smartCharging{departure: "07:00"}
+	s.configure(c)
+	return s
+}
+
+func (s *smartCharging) configure(c *WallboxConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.priceTopic != c.SmartCharging.PriceTopic {
+		s.prices = nil
+	}
+	s.priceTopic = c.SmartCharging.PriceTopic
+	s.power = c.SmartCharging.ChargingPowerKW * 1000
+}
+
+func (s *smartCharging) topic() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.priceTopic
+}
+
+func (s *smartCharging) priceHandler(client mqttClient, msg *message) {
+	prices, err := scheduler.ParsePrices(msg.Payload)
+	if err != nil {
+		slog.Warn("Ignoring invalid spot prices", "topic", msg.Topic, "error", err)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if msg.Topic != s.priceTopic {
+		return
+	}
+	s.prices = prices
+	slog.Info("Received spot prices", "slots", len(prices))
+}
+
+func (s *smartCharging) setEnabled(val string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.enabled = val == "1"
+	return nil
+}
+
+func (s *smartCharging) setDeparture(val string) error {
+	if !departurePattern.MatchString(val) {
+		return fmt.Errorf("departure %q must be HH:MM", val)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.departure = val
+	return nil
+}
+
+func (s *smartCharging) setEnergy(val string) error {
+	energy, err := strconv.ParseFloat(val, 64)
+	if err != nil || energy < 0 {
+		return fmt.Errorf("invalid required energy %q", val)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.energy = energy
+	return nil
+}
+
+func nextDeparture(now time.Time, departure string) time.Time {
+	offset, _ := parseClock(departure)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	next := midnight.Add(offset)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// update plans again and reports whether charging should wait for a
+// cheaper hour.
+func (s *smartCharging) update(w *wallbox.Wallbox) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.enabled || w.CableConnected() == 0 || len(s.prices) == 0 {
+		s.plan = nil
+		s.waiting = false
+		return false
+	}
+
+	now := time.Now()
+	remaining := s.energy*1000 - w.Data().RedisState.ScheduleEnergy
+	plan, ok := scheduler.Plan(s.prices, now, nextDeparture(now, s.departure), remaining, s.power)
+	s.plan = plan
+
+	// Without a plan that covers the remaining energy, charge right away.
+	waiting := ok && !scheduler.Active(plan, now)
+	if waiting != s.waiting {
+		slog.Info("Smart charging", "waiting", waiting, "planned", ok, "remaining_wh", remaining)
+	}
+	s.waiting = waiting
+	return waiting
+}
+
+func (s *smartCharging) nextStart() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.plan) == 0 {
+		return "None"
+	}
+	return s.plan[0].Start.Format(time.RFC3339)
+}
+
+func (s *smartCharging) attributes() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	plan := s.plan
+	if plan == nil {
+		plan = []scheduler.Slot{}
+	}
+	return map[string]interface{}{
+		"departure":  s.departure,
+		"energy_kwh": s.energy,
+		"schedule":   plan,
+	}
+}
+
+func getSmartChargingEntities(s *smartCharging) map[string]Entity {
+	return map[string]Entity{
+		"smart_charging": {
+			Component: "switch",
+			Setter:    s.setEnabled,
+			Getter: func() string {
+				s.mutex.Lock()
+				defer s.mutex.Unlock()
+				if s.enabled {
+					return "1"
+				}
+				return "0"
+			},
+			Config: map[string]interface{}{
+				"name":        "Smart charging",
+				"payload_on":  "1",
+				"payload_off": "0",
+				"icon":        "mdi:cash-clock",
+			},
+		},
+		"smart_charging_departure": {
+			Component: "text",
+			Setter:    s.setDeparture,
+			Getter: func() string {
+				s.mutex.Lock()
+				defer s.mutex.Unlock()
+				return s.departure
+			},
+			Config: map[string]interface{}{
+				"name":    "Departure time",
+				"pattern": departurePattern.String(),
+				"min":     5,
+				"max":     5,
+				"icon":    "mdi:clock-end",
+			},
+		},
+		"smart_charging_energy": {
+			Component: "number",
+			Setter:    s.setEnergy,
+			Getter: func() string {
+				s.mutex.Lock()
+				defer s.mutex.Unlock()
+				return fmt.Sprint(s.energy)
+			},
+			Config: map[string]interface{}{
+				"name":                "Required energy",
+				"min":                 "0",
+				"max":                 "100",
+				"step":                "0.5",
+				"mode":                "box",
+				"unit_of_measurement": "kWh",
+				"device_class":        "energy",
+			},
+		},
+		"smart_charging_schedule": {
+			Component:  "sensor",
+			Getter:     s.nextStart,
+			Attributes: s.attributes,
+			Config: map[string]interface{}{
+				"name":         "Next charging slot",
+				"device_class": "timestamp",
+				"icon":         "mdi:calendar-clock",
+			},
+		},
+	}
+}
@@ -0,0 +1,59 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var statusPath = filepath.Join(os.TempDir(), "mqtt-bridge.status")
+
+// bridgeStatus is written by the running bridge after every poll so that
+// `bridge status` can report on it without talking to the process.
+type bridgeStatus struct {
+	Version       string    `json:"version"`
+	PID           int       `json:"pid"`
+	StartedAt     time.Time `json:"started_at"`
+	LastPoll      time.Time `json:"last_poll"`
+	MQTTConnected bool      `json:"mqtt_connected"`
+}
+
+func writeStatus(status bridgeStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	tmpPath := statusPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, statusPath)
+}
+
+func readStatus() (*bridgeStatus, error) {
+	data, err := os.ReadFile(statusPath)
+	if err != nil {
+		return nil, err
+	}
+	var status bridgeStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// processAlive reports whether the process with the given PID still exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -3,29 +3,12 @@ package bridge
 import (
 	"bufio"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
-)
-
-var service = `[Unit]
-Description=MQTT Bridge
-After=network.target
-Requires=mysqld.service
-StartLimitIntervalSec=0
-
-[Service]
-Type=simple
-Restart=always
-RestartSec=1
-User=root
-ExecStart=/home/root/mqtt-bridge/bridge /home/root/mqtt-bridge/bridge.ini
 
-[Install]
-WantedBy=multi-user.target
-`
+	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app/wallbox"
+)
 
 func askConfirmOrNew(field *string, name string) {
 	fmt.Printf("%s (%s): ", name, *field)
@@ -48,45 +31,91 @@ func askConfirmOrNewInt(field *int, name string) {
 }
 
 func askConfirmOrNewBool(field *bool, name string) {
-	fmt.Printf("%s (y/N): ", name)
+	if *field {
+		fmt.Printf("%s (Y/n): ", name)
+	} else {
+		fmt.Printf("%s (y/N): ", name)
+	}
 	reader := bufio.NewReader(os.Stdin)
 	input, _ := reader.ReadString('\n')
 	input = strings.TrimSpace(input)
-	if len(input) > 0 && input == "y" {
+	if input == "y" {
 		*field = true
+	} else if input == "n" {
+		*field = false
 	}
 }
 
-func installService() {
-	ioutil.WriteFile("/lib/systemd/system/mqtt-bridge.service", []byte(service), 0644)
-	var cmd *exec.Cmd
-	cmd = exec.Command("systemctl", "daemon-reload")
-	cmd.Run()
-	cmd = exec.Command("systemctl", "enable", "mqtt-bridge")
-	cmd.Run()
-	cmd = exec.Command("systemctl", "restart", "mqtt-bridge")
-	cmd.Run()
+func testMQTT(config *WallboxConfig) error {
+	client, err := connectMQTT(config.toolConfig(), "", nil)
+	if err != nil {
+		return err
+	}
+	fmt.Print("(MQTT ", client.ProtocolVersion(), ") ")
+	client.Disconnect()
+	return nil
+}
+
+func testConnections(config *WallboxConfig) bool {
+	if problems := config.validate(); len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println("Invalid value:", problem)
+		}
+		return false
+	}
+
+	ok := true
+
+	fmt.Print("Connecting to MQTT broker... ")
+	if err := testMQTT(config); err != nil {
+		fmt.Println("failed:", err)
+		ok = false
+	} else {
+		fmt.Println("ok")
+	}
+
+	for _, cc := range config.chargerConfigs() {
+		fmt.Printf("Connecting to Redis and MySQL for %s... ", cc.DeviceName)
+		w, err := wallbox.Connect(cc.Wallbox.wallboxConfig())
+		if err != nil {
+			fmt.Println("failed:", err)
+			ok = false
+			continue
+		}
+		fmt.Println("ok")
+		fmt.Println("Serial number:", w.SerialNumber())
+		fmt.Printf("Max current: %d A\n", w.AvailableCurrent())
+		w.Close()
+	}
+
+	return ok
 }
 
 func RunTuiSetup() {
-	config := WallboxConfig{}
-	config.MQTT.Host = "127.0.0.1"
-	config.MQTT.Port = 1883
-	config.MQTT.Username = ""
-	config.MQTT.Password = ""
-	config.Settings.PollingIntervalSeconds = 1
-	config.Settings.DeviceName = "Wallbox"
-	config.Settings.DebugSensors = false
-
-	askConfirmOrNew(&config.MQTT.Host, "MQTT Host")
-	askConfirmOrNewInt(&config.MQTT.Port, "MQTT Port")
-	askConfirmOrNew(&config.MQTT.Username, "MQTT Username")
-	askConfirmOrNew(&config.MQTT.Password, "MQTT Password")
-	askConfirmOrNewInt(&config.Settings.PollingIntervalSeconds, "Polling interval")
-	askConfirmOrNew(&config.Settings.DeviceName, "Device name")
-	askConfirmOrNewBool(&config.Settings.DebugSensors, "Debug sensors")
-
-	config.SaveTo("bridge.ini")
-
-	installService()
+	configPath := serviceConfigPath()
+	config := loadConfigOrDefaults(configPath)
+
+	for {
+		askConfirmOrNew(&config.MQTT.Host, "MQTT Host")
+		askConfirmOrNewInt(&config.MQTT.Port, "MQTT Port")
+		askConfirmOrNew(&config.MQTT.Username, "MQTT Username")
+		askConfirmOrNew(&config.MQTT.Password, "MQTT Password")
+		askConfirmOrNewInt(&config.Settings.PollingIntervalSeconds, "Polling interval")
+		askConfirmOrNew(&config.Settings.DeviceName, "Device name")
+		askConfirmOrNewBool(&config.Settings.DebugSensors, "Debug sensors")
+
+		reenter := !testConnections(config)
+		askConfirmOrNewBool(&reenter, "Re-enter values")
+		if !reenter {
+			break
+		}
+	}
+
+	if err := config.SaveTo(configPath); err != nil {
+		fmt.Println("Unable to save config:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Saved config to", configPath)
+
+	installService(configPath)
 }
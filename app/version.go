@@ -0,0 +1,4 @@
+package bridge
+
+// Version is set at build time with -ldflags "-X ...bridge.Version=...".
+var Version = "dev"
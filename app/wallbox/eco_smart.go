@@ -0,0 +1,46 @@
+package wallbox
+
+import "fmt"
+
+func (w *Wallbox) EcoSmartMode() string {
+	data := w.Data()
+	if data.SQL.EcoSmartEnabled == 0 {
+		return EcoSmartModes[0]
+	}
+	mode := data.SQL.EcoSmartMode + 1
+	if mode < 1 || mode >= len(EcoSmartModes) {
+		return fmt.Sprint(data.SQL.EcoSmartMode)
+	}
+	return EcoSmartModes[mode]
+}
+
+func (w *Wallbox) WaitingForEcoPower() int {
+	if w.Data().RedisState.SessionState == stateWaitingEcoPower {
+		return 1
+	}
+	return 0
+}
+
+func (w *Wallbox) SetEcoSmartMode(mode string) error {
+	switch mode {
+	case EcoSmartModes[0]:
+		_, err := w.sqlClient.Exec("UPDATE `wallbox_config` SET `ecosmart_enabled`=0")
+		return err
+	case EcoSmartModes[1], EcoSmartModes[2]:
+		ecoSmartMode := 0
+		if mode == EcoSmartModes[2] {
+			ecoSmartMode = 1
+		}
+		_, err := w.sqlClient.Exec("UPDATE `wallbox_config` SET `ecosmart_enabled`=1, `ecosmart_mode`=?", ecoSmartMode)
+		return err
+	}
+	return fmt.Errorf("unknown Eco-Smart mode %q", mode)
+}
+
+func (w *Wallbox) SetEcoSmartPercentage(percentage int) error {
+	if percentage < 0 || percentage > 100 {
+		return fmt.Errorf("Eco-Smart percentage must be between 0 and 100, got %d", percentage)
+	}
+	_, err := w.sqlClient.Exec("UPDATE `wallbox_config` SET `ecosmart_percentage`=?", percentage)
+	return err
+}
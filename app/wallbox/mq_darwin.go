@@ -1,5 +0,0 @@
-package wallbox
-
-func mqOpen(path []byte) uintptr                  { return 0 }
-func mqTimedsend(fd uintptr, data []byte) uintptr { return 0 }
-func mqClose(fd uintptr)                          {}
@@ -1,3 +1,5 @@
+//go:build linux && (amd64 || arm || arm64)
+
 package wallbox
 
 import (
@@ -5,8 +7,8 @@ import (
 	"unsafe"
 )
 
-func mqOpen(path []byte) uintptr {
-	mq, _, _ := syscall.Syscall6(
+func mqOpen(path []byte) (uintptr, error) {
+	mq, _, errno := syscall.Syscall6(
 		uintptr(MqOpenSyscall),
 		uintptr(unsafe.Pointer(&path[0])),
 		uintptr(0x02),
@@ -15,12 +17,15 @@ func mqOpen(path []byte) uintptr {
 		uintptr(0),
 		uintptr(0),
 	)
+	if errno != 0 {
+		return 0, errno
+	}
 
-	return mq
+	return mq, nil
 }
 
-func mqTimedsend(fd uintptr, data []byte) uintptr {
-	mqLock, _, _ := syscall.Syscall6(
+func mqTimedsend(fd uintptr, data []byte) error {
+	_, _, errno := syscall.Syscall6(
 		uintptr(MqTimedSendSyscall),
 		uintptr(fd),
 		uintptr(unsafe.Pointer(&data[0])),
@@ -29,8 +34,11 @@ func mqTimedsend(fd uintptr, data []byte) uintptr {
 		uintptr(0),
 		uintptr(0),
 	)
+	if errno != 0 {
+		return errno
+	}
 
-	return mqLock
+	return nil
 }
 
 func mqClose(fd uintptr) {
@@ -0,0 +1,16 @@
+//go:build !linux || !(amd64 || arm || arm64)
+
+package wallbox
+
+import (
+	"errors"
+	"runtime"
+)
+
+// POSIX message queues are only reachable where the syscall numbers are
+// known. Elsewhere the bridge can still run with a helper_addr.
+var errNoPosixQueue = errors.New("POSIX message queues are not supported on " + runtime.GOOS + "/" + runtime.GOARCH + ", set helper_addr")
+
+func mqOpen(path []byte) (uintptr, error)       { return 0, errNoPosixQueue }
+func mqTimedsend(fd uintptr, data []byte) error { return errNoPosixQueue }
+func mqClose(fd uintptr)                        {}
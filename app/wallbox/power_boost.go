@@ -0,0 +1,69 @@
+package wallbox
+
+import "fmt"
+
+const (
+	minCurrent           = 6
+	maxPowerBoostCurrent = 100
+)
+
+func (w *Wallbox) PowerSharingMode() string {
+	mode := w.Data().SQL.PowerSharingMode
+	if mode < 0 || mode >= len(PowerSharingModes) {
+		return fmt.Sprint(mode)
+	}
+	return PowerSharingModes[mode]
+}
+
+func (w *Wallbox) SetPowerBoostEnable(enable int) error {
+	if enable != 0 && enable != 1 {
+		return fmt.Errorf("power boost enable must be 0 or 1, got %d", enable)
+	}
+	_, err := w.sqlClient.Exec("UPDATE `wallbox_config` SET `power_boost_enable`=?", enable)
+	return err
+}
+
+// SetPowerBoostMaxCurrent sets the current of the home's main fuse that
+// Power Boost keeps the total consumption below.
+func (w *Wallbox) SetPowerBoostMaxCurrent(current int) error {
+	if current < minCurrent || current > maxPowerBoostCurrent {
+		return fmt.Errorf("power boost max current must be between %d and %d A, got %d", minCurrent, maxPowerBoostCurrent, current)
+	}
+	_, err := w.sqlClient.Exec("UPDATE `wallbox_config` SET `icp_max_current`=?", current)
+	return err
+}
+
+// SetPowerSharingMode changes the charger's role in a power sharing group.
+// It is refused while charging since the group renegotiates current when
+// the role changes.
+func (w *Wallbox) SetPowerSharingMode(mode string) error {
+	index := -1
+	for i, m := range PowerSharingModes {
+		if m == mode {
+			index = i
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("unknown power sharing mode %q", mode)
+	}
+
+	if err := w.RefreshData(); err != nil {
+		return err
+	}
+	if index == w.Data().SQL.PowerSharingMode {
+		return nil
+	}
+	if w.IsCharging() {
+		return fmt.Errorf("power sharing mode cannot be changed while charging")
+	}
+	_, err := w.sqlClient.Exec("UPDATE `wallbox_config` SET `power_sharing_mode`=?", index)
+	return err
+}
+
+func (w *Wallbox) SetPowerSharingMaxCurrent(current int) error {
+	if current < minCurrent || current > maxPowerBoostCurrent {
+		return fmt.Errorf("power sharing max current must be between %d and %d A, got %d", minCurrent, maxPowerBoostCurrent, current)
+	}
+	_, err := w.sqlClient.Exec("UPDATE `wallbox_config` SET `power_sharing_max_current`=?", current)
+	return err
+}
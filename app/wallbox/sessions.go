@@ -0,0 +1,58 @@
+package wallbox
+
+import "time"
+
+type Session struct {
+	ID     int64     `json:"id"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Energy float64   `json:"energy_wh"`
+	Range  float64   `json:"range_km"`
+	UserID int64     `json:"user_id"`
+	User   string    `json:"user"`
+}
+
+type sessionRow struct {
+	ID     int64   `db:"id"`
+	Start  int64   `db:"start"`
+	End    int64   `db:"end"`
+	Energy float64 `db:"energy_total"`
+	Range  float64 `db:"charged_range"`
+	UserID int64   `db:"user_id"`
+	User   string  `db:"user"`
+}
+
+// Sessions returns the sessions that started in [from, to), oldest first.
+func (w *Wallbox) Sessions(from, to time.Time) ([]Session, error) {
+	query := "SELECT " +
+		"  `session`.`id`," +
+		"  `session`.`start`," +
+		"  `session`.`end`," +
+		"  `session`.`energy_total`," +
+		"  `session`.`charged_range`," +
+		"  `session`.`user_id`," +
+		"  IFNULL(`users`.`name`, '') AS user " +
+		"FROM `session` " +
+		"LEFT JOIN `users` ON `users`.`user_id` = `session`.`user_id` " +
+		"WHERE `session`.`start` >= ? AND `session`.`start` < ? " +
+		"ORDER BY `session`.`start`"
+
+	var rows []sessionRow
+	if err := w.sqlClient.Select(&rows, query, from.Unix(), to.Unix()); err != nil {
+		return nil, err
+	}
+
+	sessions := make([]Session, len(rows))
+	for i, row := range rows {
+		sessions[i] = Session{
+			ID:     row.ID,
+			Start:  time.Unix(row.Start, 0),
+			End:    time.Unix(row.End, 0),
+			Energy: row.Energy,
+			Range:  row.Range,
+			UserID: row.UserID,
+			User:   row.User,
+		}
+	}
+	return sessions, nil
+}
@@ -0,0 +1,143 @@
+package wallbox
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const (
+	LoginQueue        = "WALLBOX_MYWALLBOX_WALLBOX_LOGIN"
+	StateMachineQueue = "WALLBOX_MYWALLBOX_WALLBOX_STATEMACHINE"
+)
+
+var allowedQueues = map[string]bool{
+	LoginQueue:        true,
+	StateMachineQueue: true,
+}
+
+// Transport delivers events to the charger's POSIX message queues, either
+// directly or through a helper running on the charger.
+type Transport interface {
+	Send(queue, event string) error
+}
+
+type PosixQueue struct{}
+
+func (PosixQueue) Send(queue, event string) error {
+	return sendToPosixQueue(queue, event)
+}
+
+func sendToPosixQueue(path, data string) error {
+	if len(data) > 1024 {
+		return fmt.Errorf("event %q is too long", data)
+	}
+
+	pathBytes := append([]byte(path), 0)
+	mq, err := mqOpen(pathBytes)
+	if err != nil {
+		return fmt.Errorf("open queue %s: %w", path, err)
+	}
+	defer mqClose(mq)
+
+	event := []byte(data)
+	eventPaddedBytes := append(event, bytes.Repeat([]byte{0x00}, 1024-len(event))...)
+
+	if err := mqTimedsend(mq, eventPaddedBytes); err != nil {
+		return fmt.Errorf("send to queue %s: %w", path, err)
+	}
+	return nil
+}
+
+type helperRequest struct {
+	Token string `json:"token"`
+	Queue string `json:"queue"`
+	Event string `json:"event"`
+}
+
+type helperResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// HelperTransport forwards events over TCP to ServeHelper on the charger,
+// one JSON request and response per line.
+type HelperTransport struct {
+	Addr    string
+	Token   string
+	Timeout time.Duration
+}
+
+func (h HelperTransport) Send(queue, event string) error {
+	conn, err := net.DialTimeout("tcp", h.Addr, h.Timeout)
+	if err != nil {
+		return fmt.Errorf("helper: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(h.Timeout))
+
+	if err := json.NewEncoder(conn).Encode(helperRequest{Token: h.Token, Queue: queue, Event: event}); err != nil {
+		return fmt.Errorf("helper: %w", err)
+	}
+	var response helperResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return fmt.Errorf("helper: %w", err)
+	}
+	if response.Error != "" {
+		return fmt.Errorf("helper: %s", response.Error)
+	}
+	return nil
+}
+
+// ServeHelper accepts events from HelperTransport and puts them on the local
+// POSIX queues. Only the charger's known queues are accepted.
+func ServeHelper(listener net.Listener, token string) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go handleHelperConn(conn, token)
+	}
+}
+
+func handleHelperConn(conn net.Conn, token string) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var request helperRequest
+		var err error
+		if err = json.Unmarshal(scanner.Bytes(), &request); err == nil {
+			err = handleHelperRequest(request, token)
+		}
+
+		response := helperResponse{}
+		if err != nil {
+			response.Error = err.Error()
+			slog.Warn("Rejected helper request", "remote", conn.RemoteAddr().String(), "error", err)
+		} else {
+			slog.Info("Forwarded event", "remote", conn.RemoteAddr().String(), "queue", request.Queue, "event", request.Event)
+		}
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+func handleHelperRequest(request helperRequest, token string) error {
+	if subtle.ConstantTimeCompare([]byte(request.Token), []byte(token)) != 1 {
+		return errors.New("invalid token")
+	}
+	if !allowedQueues[request.Queue] {
+		return fmt.Errorf("queue %q is not allowed", request.Queue)
+	}
+	return sendToPosixQueue(request.Queue, request.Event)
+}
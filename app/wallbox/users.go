@@ -0,0 +1,60 @@
+package wallbox
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type User struct {
+	ID   int    `db:"user_id" json:"id"`
+	Name string `db:"name" json:"name"`
+}
+
+// Label is a unique, readable name for the user, used as select option.
+func (u User) Label() string {
+	return fmt.Sprintf("%s (%d)", u.Name, u.ID)
+}
+
+func (w *Wallbox) Users() ([]User, error) {
+	var users []User
+	err := w.sqlClient.Select(&users, "SELECT `user_id`, IFNULL(`name`, '') AS name FROM `users` WHERE `user_id` != 1 ORDER BY `user_id`")
+	return users, err
+}
+
+func (w *Wallbox) SessionUser() string {
+	data := w.Data()
+	if data.SQL.SessionUserID == 0 {
+		return "None"
+	}
+	return data.SQL.SessionUser
+}
+
+func (w *Wallbox) SessionUserLabel() string {
+	data := w.Data()
+	if data.SQL.SessionUserID == 0 {
+		return NoUser
+	}
+	return User{ID: data.SQL.SessionUserID, Name: data.SQL.SessionUser}.Label()
+}
+
+// NoUser is the unlock option shown while no user is logged in, or one
+// that is not in the options.
+const NoUser = "None"
+
+// UnlockAs unlocks the charger on behalf of the user with the given label,
+// so that the session is attributed to them.
+func (w *Wallbox) UnlockAs(label string) error {
+	if label == NoUser {
+		return fmt.Errorf("choose a user to unlock as")
+	}
+	users, err := w.Users()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if user.Label() == label {
+			return w.transport.Send(LoginQueue, "EVENT_REQUEST_LOGIN#"+strconv.Itoa(user.ID)+".000000")
+		}
+	}
+	return fmt.Errorf("unknown user %q", label)
+}
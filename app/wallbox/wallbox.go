@@ -1,12 +1,16 @@
 package wallbox
 
 import (
-	"bytes"
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"net"
 	"reflect"
+	"sync"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/redis/go-redis/v9"
 )
@@ -19,6 +23,15 @@ type DataCache struct {
 		HaloBrightness        int     `db:"halo_brightness"`
 		CumulativeAddedEnergy float64 `db:"cumulative_added_energy"`
 		AddedRange            float64 `db:"added_range"`
+		PowerBoostEnable      int     `db:"power_boost_enable"`
+		PowerBoostMaxCurrent  int     `db:"icp_max_current"`
+		PowerSharingMode      int     `db:"power_sharing_mode"`
+		PowerSharingCurrent   int     `db:"power_sharing_max_current"`
+		EcoSmartEnabled       int     `db:"ecosmart_enabled"`
+		EcoSmartMode          int     `db:"ecosmart_mode"`
+		EcoSmartPercentage    int     `db:"ecosmart_percentage"`
+		SessionUserID         int     `db:"session_user_id"`
+		SessionUser           string  `db:"session_user"`
 	}
 
 	RedisState struct {
@@ -34,30 +47,210 @@ type DataCache struct {
 		Line2Power    float64 `redis:"tms.line2.power_watt.value"`
 		Line3Power    float64 `redis:"tms.line3.power_watt.value"`
 	}
+
+	// Users is only read with FeatureUsers.
+	Users []User
 }
 
 type Wallbox struct {
 	redisClient *redis.Client
 	sqlClient   *sqlx.DB
-	Data        DataCache
+	transport   Transport
+
+	// data is replaced as a whole by RefreshData, which can run on several
+	// goroutines at once since setters refresh too.
+	mutex sync.RWMutex
+	data  DataCache
+
+	// supported is set by Connect and not changed after.
+	supported map[Feature]bool
+}
+
+// Feature is a group of settings that not every firmware has. Each is read
+// with its own query, so that a missing column only hides its own entities.
+type Feature string
+
+const (
+	FeaturePowerBoost   Feature = "power_boost"
+	FeaturePowerSharing Feature = "power_sharing"
+	FeatureEcoSmart     Feature = "eco_smart"
+	FeatureUsers        Feature = "users"
+)
+
+// MySQL error numbers for a missing column and a missing table.
+const (
+	errBadField    = 1054
+	errNoSuchTable = 1146
+)
+
+var features = []Feature{FeaturePowerBoost, FeaturePowerSharing, FeatureEcoSmart, FeatureUsers}
+
+var featureQueries = map[Feature]string{
+	FeaturePowerBoost:   "SELECT `power_boost_enable`, `icp_max_current` FROM `wallbox_config`",
+	FeaturePowerSharing: "SELECT `power_sharing_mode`, `power_sharing_max_current` FROM `wallbox_config`",
+	FeatureEcoSmart:     "SELECT `ecosmart_enabled`, `ecosmart_mode`, `ecosmart_percentage` FROM `wallbox_config`",
+	FeatureUsers: "SELECT " +
+		"  IFNULL(`active_session`.`user_id`, 0) AS session_user_id," +
+		"  IFNULL((SELECT `name` FROM `users` WHERE `users`.`user_id` = `active_session`.`user_id`), '') AS session_user " +
+		"FROM `active_session`",
+}
+
+const (
+	DefaultMySQLDSN = "root:fJmExsJgmKV7cq8H@tcp(127.0.0.1:3306)/wallbox"
+	DefaultRedisURL = "redis://localhost:6379/0"
+)
+
+// Config describes how to reach the charger's databases. Zero pool sizes
+// leave the driver defaults in place.
+type Config struct {
+	MySQLDSN          string
+	RedisURL          string
+	Timeout           time.Duration
+	MySQLMaxOpenConns int
+	MySQLMaxIdleConns int
+	RedisPoolSize     int
+	// HelperAddr, when set, sends queue events to a helper on the charger
+	// instead of the local POSIX queues.
+	HelperAddr  string
+	HelperToken string
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MySQLDSN: DefaultMySQLDSN,
+		RedisURL: DefaultRedisURL,
+		Timeout:  5 * time.Second,
+	}
+}
+
+func (c Config) transport() Transport {
+	if c.HelperAddr == "" {
+		return PosixQueue{}
+	}
+	return HelperTransport{Addr: c.HelperAddr, Token: c.HelperToken, Timeout: c.Timeout}
+}
+
+func (c Config) mysqlDSN() (string, error) {
+	dsn, err := mysql.ParseDSN(c.MySQLDSN)
+	if err != nil {
+		return "", err
+	}
+	if c.Timeout > 0 {
+		dsn.Timeout = c.Timeout
+		dsn.ReadTimeout = c.Timeout
+		dsn.WriteTimeout = c.Timeout
+	}
+	return dsn.FormatDSN(), nil
 }
 
-func New() *Wallbox {
-	var w Wallbox
+func (c Config) redisOptions() (*redis.Options, error) {
+	opts, err := redis.ParseURL(c.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	if c.Timeout > 0 {
+		opts.DialTimeout = c.Timeout
+		opts.ReadTimeout = c.Timeout
+		opts.WriteTimeout = c.Timeout
+	}
+	if c.RedisPoolSize > 0 {
+		opts.PoolSize = c.RedisPoolSize
+	}
+	return opts, nil
+}
 
-	var err error
-	w.sqlClient, err = sqlx.Connect("mysql", "root:fJmExsJgmKV7cq8H@tcp(127.0.0.1:3306)/wallbox")
+// Validate checks that the DSNs can be parsed, without connecting.
+func (c Config) Validate() error {
+	if _, err := c.mysqlDSN(); err != nil {
+		return fmt.Errorf("mysql: %w", err)
+	}
+	if _, err := c.redisOptions(); err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	if c.HelperAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HelperAddr); err != nil {
+			return fmt.Errorf("helper: %w", err)
+		}
+	}
+	return nil
+}
+
+func New(config Config) *Wallbox {
+	w, err := Connect(config)
 	if err != nil {
 		panic(err)
 	}
+	return w
+}
+
+func Connect(config Config) (*Wallbox, error) {
+	dsn, err := config.mysqlDSN()
+	if err != nil {
+		return nil, fmt.Errorf("mysql: %w", err)
+	}
+	redisOptions, err := config.redisOptions()
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	sqlClient, err := sqlx.Connect("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: %w", err)
+	}
+	if config.MySQLMaxOpenConns > 0 {
+		sqlClient.SetMaxOpenConns(config.MySQLMaxOpenConns)
+	}
+	if config.MySQLMaxIdleConns > 0 {
+		sqlClient.SetMaxIdleConns(config.MySQLMaxIdleConns)
+	}
+
+	return Open(redis.NewClient(redisOptions), sqlClient, config.transport())
+}
+
+// Open uses clients that are already set up, and closes them on failure.
+func Open(redisClient *redis.Client, sqlClient *sqlx.DB, transport Transport) (*Wallbox, error) {
+	w := &Wallbox{redisClient: redisClient, sqlClient: sqlClient, transport: transport}
+
+	if err := w.redisClient.Ping(context.Background()).Err(); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("redis: %w", err)
+	}
 
-	w.redisClient = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
+	if err := w.detectFeatures(); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("mysql: %w", err)
+	}
+
+	return w, nil
+}
+
+// detectFeatures runs each feature query once. Features whose tables or
+// columns are missing are left out, other errors fail.
+func (w *Wallbox) detectFeatures() error {
+	w.supported = map[Feature]bool{}
+	for _, feature := range features {
+		var data DataCache
+		err := w.sqlClient.Get(&data.SQL, featureQueries[feature])
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && (mysqlErr.Number == errBadField || mysqlErr.Number == errNoSuchTable) {
+			continue
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		w.supported[feature] = true
+	}
+	return nil
+}
 
-	return &w
+// Supports reports whether the firmware has the feature's settings.
+func (w *Wallbox) Supports(feature Feature) bool {
+	return w.supported[feature]
+}
+
+func (w *Wallbox) Close() {
+	w.redisClient.Close()
+	w.sqlClient.Close()
 }
 
 func getRedisFields(obj interface{}) []string {
@@ -73,25 +266,41 @@ func getRedisFields(obj interface{}) []string {
 	return result
 }
 
-func (w *Wallbox) RefreshData() {
+var (
+	ErrRedis = errors.New("redis")
+	ErrSQL   = errors.New("mysql")
+)
+
+// Data returns a snapshot of the data cache, safe to read while it is being
+// refreshed.
+func (w *Wallbox) Data() DataCache {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.data
+}
+
+// RefreshData reloads the data cache. Errors wrap ErrRedis or ErrSQL
+// depending on which source failed, in which case the cache is unchanged.
+func (w *Wallbox) RefreshData() error {
 	ctx := context.Background()
+	data := w.Data()
 
-	stateRes := w.redisClient.HMGet(ctx, "state", getRedisFields(w.Data.RedisState)...)
+	stateRes := w.redisClient.HMGet(ctx, "state", getRedisFields(data.RedisState)...)
 	if stateRes.Err() != nil {
-		panic(stateRes.Err())
+		return fmt.Errorf("%w: %w", ErrRedis, stateRes.Err())
 	}
 
-	if err := stateRes.Scan(&w.Data.RedisState); err != nil {
-		panic(err)
+	if err := stateRes.Scan(&data.RedisState); err != nil {
+		return fmt.Errorf("%w: %w", ErrRedis, err)
 	}
 
-	m2wRes := w.redisClient.HMGet(ctx, "m2w", getRedisFields(w.Data.RedisM2W)...)
+	m2wRes := w.redisClient.HMGet(ctx, "m2w", getRedisFields(data.RedisM2W)...)
 	if m2wRes.Err() != nil {
-		panic(m2wRes.Err())
+		return fmt.Errorf("%w: %w", ErrRedis, m2wRes.Err())
 	}
 
-	if err := m2wRes.Scan(&w.Data.RedisM2W); err != nil {
-		panic(err)
+	if err := m2wRes.Scan(&data.RedisM2W); err != nil {
+		return fmt.Errorf("%w: %w", ErrRedis, err)
 	}
 
 	query := "SELECT " +
@@ -107,7 +316,29 @@ func (w *Wallbox) RefreshData() {
 		"    `active_session`," +
 		"    `power_outage_values`," +
 		"    (SELECT * FROM `session` ORDER BY `id` DESC LIMIT 1) AS latest_session"
-	w.sqlClient.Get(&w.Data.SQL, query)
+	if err := w.sqlClient.Get(&data.SQL, query); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %w", ErrSQL, err)
+	}
+	for _, feature := range features {
+		if !w.supported[feature] {
+			continue
+		}
+		if err := w.sqlClient.Get(&data.SQL, featureQueries[feature]); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %w", ErrSQL, err)
+		}
+	}
+	if w.supported[FeatureUsers] {
+		users, err := w.Users()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrSQL, err)
+		}
+		data.Users = users
+	}
+
+	w.mutex.Lock()
+	w.data = data
+	w.mutex.Unlock()
+	return nil
 }
 
 func (w *Wallbox) SerialNumber() string {
@@ -128,72 +359,101 @@ func (w *Wallbox) AvailableCurrent() int {
 	return availableCurrent
 }
 
-func sendToPosixQueue(path, data string) {
-	pathBytes := append([]byte(path), 0)
-	mq := mqOpen(pathBytes)
-
-	event := []byte(data)
-	eventPaddedBytes := append(event, bytes.Repeat([]byte{0x00}, 1024-len(event))...)
-
-	mqTimedsend(mq, eventPaddedBytes)
-	mqClose(mq)
-}
-
-func (w *Wallbox) SetLocked(lock int) {
-	w.RefreshData()
-	if lock == w.Data.SQL.Lock {
-		return
+func (w *Wallbox) SetLocked(lock int) error {
+	if err := w.RefreshData(); err != nil {
+		return err
+	}
+	if lock == w.Data().SQL.Lock {
+		return nil
 	}
 	if lock == 1 {
-		sendToPosixQueue("WALLBOX_MYWALLBOX_WALLBOX_LOGIN", "EVENT_REQUEST_LOCK")
-	} else {
-		userId := w.UserId()
-		sendToPosixQueue("WALLBOX_MYWALLBOX_WALLBOX_LOGIN", "EVENT_REQUEST_LOGIN#"+userId+".000000")
+		return w.transport.Send(LoginQueue, "EVENT_REQUEST_LOCK")
 	}
+	userId := w.UserId()
+	return w.transport.Send(LoginQueue, "EVENT_REQUEST_LOGIN#"+userId+".000000")
 }
 
-func (w *Wallbox) SetChargingEnable(enable int) {
-	w.RefreshData()
-	if enable == w.Data.SQL.ChargingEnable {
-		return
+func (w *Wallbox) SetChargingEnable(enable int) error {
+	if err := w.RefreshData(); err != nil {
+		return err
+	}
+	if enable == w.Data().SQL.ChargingEnable {
+		return nil
 	}
 	if enable == 1 {
-		sendToPosixQueue("WALLBOX_MYWALLBOX_WALLBOX_STATEMACHINE", "EVENT_REQUEST_USER_ACTION#1.000000")
-	} else {
-		sendToPosixQueue("WALLBOX_MYWALLBOX_WALLBOX_STATEMACHINE", "EVENT_REQUEST_USER_ACTION#2.000000")
+		return w.transport.Send(StateMachineQueue, "EVENT_REQUEST_USER_ACTION#1.000000")
 	}
+	return w.transport.Send(StateMachineQueue, "EVENT_REQUEST_USER_ACTION#2.000000")
+}
+
+func (w *Wallbox) Pause() error {
+	return w.transport.Send(StateMachineQueue, "EVENT_REQUEST_USER_ACTION#2.000000")
 }
 
-func (w *Wallbox) SetMaxChargingCurrent(current int) {
-	w.sqlClient.MustExec("UPDATE `wallbox_config` SET `max_charging_current`=?", current)
+func (w *Wallbox) Resume() error {
+	return w.transport.Send(StateMachineQueue, "EVENT_REQUEST_USER_ACTION#1.000000")
 }
 
-func (w *Wallbox) SetHaloBrightness(brightness int) {
-	w.sqlClient.MustExec("UPDATE `wallbox_config` SET `halo_brightness`=?", brightness)
+func (w *Wallbox) Restart() error {
+	return w.transport.Send(StateMachineQueue, "EVENT_REQUEST_SOFTWARE_RESTART")
+}
+
+func (w *Wallbox) SetMaxChargingCurrent(current int) error {
+	_, err := w.sqlClient.Exec("UPDATE `wallbox_config` SET `max_charging_current`=?", current)
+	return err
+}
+
+func (w *Wallbox) SetHaloBrightness(brightness int) error {
+	_, err := w.sqlClient.Exec("UPDATE `wallbox_config` SET `halo_brightness`=?", brightness)
+	return err
 }
 
 func (w *Wallbox) CableConnected() int {
-	if w.Data.RedisM2W.ChargerStatus == 0 || w.Data.RedisM2W.ChargerStatus == 6 {
+	if status := w.Data().RedisM2W.ChargerStatus; status == 0 || status == 6 {
 		return 0
 	}
 	return 1
 }
 
-func (w *Wallbox) EffectiveStatus() string {
-	tmsStatus := w.Data.RedisM2W.ChargerStatus
-	state := w.Data.RedisState.SessionState
+func (w *Wallbox) IsCharging() bool {
+	return w.effectiveStatusCode() == statusCharging
+}
+
+// WantsCurrent reports whether a car is plugged in and charging or waiting
+// for current, as opposed to finished, paused or locked.
+func (w *Wallbox) WantsCurrent() bool {
+	if w.CableConnected() == 0 {
+		return false
+	}
+	switch w.effectiveStatusCode() {
+	case statusWaitingCar, statusPaused, statusLocked, statusError:
+		return false
+	}
+	return true
+}
+
+func (w *Wallbox) effectiveStatusCode() int {
+	data := w.Data()
+	tmsStatus := data.RedisM2W.ChargerStatus
+	state := data.RedisState.SessionState
 
 	if override, ok := stateOverrides[state]; ok {
 		tmsStatus = override
 	}
 
-	return wallboxStatusCodes[tmsStatus]
+	return tmsStatus
+}
+
+func (w *Wallbox) EffectiveStatus() string {
+	return wallboxStatusCodes[w.effectiveStatusCode()]
 }
 
 func (w *Wallbox) ControlPilotStatus() string {
-	return fmt.Sprintf("%d: %s", w.Data.RedisState.ControlPilot, controlPilotStates[w.Data.RedisState.ControlPilot])
+	controlPilot := w.Data().RedisState.ControlPilot
+	return fmt.Sprintf("%d: %s", controlPilot, controlPilotStates[controlPilot])
 }
 
 func (w *Wallbox) StateMachineState() string {
-	return fmt.Sprintf("%d: %s", w.Data.RedisState.SessionState, stateMachineStates[w.Data.RedisState.SessionState])
+	sessionState := w.Data().RedisState.SessionState
+	return fmt.Sprintf("%d: %s", sessionState, stateMachineStates[sessionState])
 }
@@ -22,6 +22,30 @@ var wallboxStatusCodes = []string{
 	"Queue by eco smart",
 }
 
+const (
+	statusCharging   = 1
+	statusWaitingCar = 2
+	statusPaused     = 4
+	statusLocked     = 6
+	statusError      = 7
+)
+
+var PowerSharingModes = []string{
+	"Disabled",
+	"Master",
+	"Slave",
+}
+
+const stateWaitingEcoPower = 0xBD
+
+// EcoSmartModes are the select options, "Off" disables Eco-Smart and the
+// others map to ecosmart_mode 0 and 1.
+var EcoSmartModes = []string{
+	"Off",
+	"Eco",
+	"Full green",
+}
+
 var stateOverrides = map[int]int{
 	0xA1: 0,
 	0xA2: 9,
@@ -0,0 +1,175 @@
+package wallbox
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+type recordingTransport struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (t *recordingTransport) Send(queue, event string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.events = append(t.events, event)
+	return nil
+}
+
+// newTestWallbox returns a Wallbox backed by miniredis and sqlmock, on a
+// firmware with every feature. Each refresh expects one round of queries.
+func newTestWallbox(t *testing.T, refreshes int) (*Wallbox, sqlmock.Sqlmock, *recordingTransport) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	server.HSet("state", "session.state", "194", "ctrlPilot", "1", "S2open", "0", "scheduleEnergy", "1234.5")
+	server.HSet("m2w", "tms.charger_status", "1", "tms.line1.power_watt.value", "2300", "tms.line2.power_watt.value", "0", "tms.line3.power_watt.value", "0")
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.MatchExpectationsInOrder(false)
+	expectFeatureQueries(mock)
+	for i := 0; i < refreshes; i++ {
+		mock.ExpectQuery("AS cumulative_added_energy").WillReturnRows(sqlmock.NewRows(
+			[]string{"charging_enable", "lock", "max_charging_current", "halo_brightness", "cumulative_added_energy", "added_range"}).
+			AddRow(1, 0, 16, 50, 1000.5, 12.5))
+		expectFeatureQueries(mock)
+		mock.ExpectQuery("FROM `users` WHERE").WillReturnRows(sqlmock.NewRows(
+			[]string{"user_id", "name"}).AddRow(2, "Alice").AddRow(3, "Bob"))
+	}
+
+	transport := &recordingTransport{}
+	w, err := Open(redis.NewClient(&redis.Options{Addr: server.Addr()}), sqlx.NewDb(db, "mysql"), transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, feature := range features {
+		if !w.Supports(feature) {
+			t.Fatalf("feature %s not detected", feature)
+		}
+	}
+	t.Cleanup(w.Close)
+	return w, mock, transport
+}
+
+func expectFeatureQueries(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT `power_boost_enable`").WillReturnRows(sqlmock.NewRows(
+		[]string{"power_boost_enable", "icp_max_current"}).AddRow(1, 25))
+	mock.ExpectQuery("SELECT `power_sharing_mode`").WillReturnRows(sqlmock.NewRows(
+		[]string{"power_sharing_mode", "power_sharing_max_current"}).AddRow(0, 32))
+	mock.ExpectQuery("SELECT `ecosmart_enabled`").WillReturnRows(sqlmock.NewRows(
+		[]string{"ecosmart_enabled", "ecosmart_mode", "ecosmart_percentage"}).AddRow(1, 0, 50))
+	mock.ExpectQuery("AS session_user_id").WillReturnRows(sqlmock.NewRows(
+		[]string{"session_user_id", "session_user"}).AddRow(2, "Alice"))
+}
+
+// TestRefreshDataConcurrent runs the poll loop's refreshes alongside the
+// getters that publish states and the setters that command handlers call,
+// which also refresh. Run with -race.
+func TestRefreshDataConcurrent(t *testing.T) {
+	const (
+		pollers    = 2
+		polls      = 25
+		handlers   = 2
+		commands   = 10
+		readers    = 4
+		reads      = 200
+		refreshes  = pollers*polls + handlers*commands
+		currentSet = handlers * commands
+	)
+	w, mock, transport := newTestWallbox(t, refreshes)
+	for i := 0; i < currentSet; i++ {
+		mock.ExpectExec("UPDATE `wallbox_config` SET `max_charging_current`").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < pollers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < polls; j++ {
+				if err := w.RefreshData(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < handlers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < commands; j++ {
+				if err := w.SetChargingEnable(j % 2); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := w.SetMaxChargingCurrent(6 + j); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < reads; j++ {
+				w.Data()
+				w.EffectiveStatus()
+				w.CableConnected()
+				w.WantsCurrent()
+				w.ControlPilotStatus()
+				w.EcoSmartMode()
+				w.PowerSharingMode()
+				w.SessionUserLabel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	data := w.Data()
+	if data.SQL.MaxChargingCurrent != 16 || data.RedisM2W.Line1Power != 2300 || len(data.Users) != 2 {
+		t.Errorf("unexpected data after refresh: %+v", data)
+	}
+	if got := w.SessionUserLabel(); got != "Alice (2)" {
+		t.Errorf("SessionUserLabel() = %q, want %q", got, "Alice (2)")
+	}
+	// Charging is enabled in the mock, so only the pause commands are sent.
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if len(transport.events) != handlers*commands/2 {
+		t.Errorf("sent %d events, want %d", len(transport.events), handlers*commands/2)
+	}
+}
+
+// TestRefreshDataKeepsCacheOnError checks that a failed refresh leaves the
+// previous snapshot in place for readers.
+func TestRefreshDataKeepsCacheOnError(t *testing.T) {
+	w, _, _ := newTestWallbox(t, 1)
+	if err := w.RefreshData(); err != nil {
+		t.Fatal(err)
+	}
+	before := w.Data()
+
+	// No expectations are left, so the next query fails.
+	if err := w.RefreshData(); err == nil {
+		t.Fatal("RefreshData() succeeded without a database")
+	}
+	if after := w.Data(); after.SQL != before.SQL || len(after.Users) != len(before.Users) {
+		t.Errorf("cache changed after a failed refresh: %+v, was %+v", after, before)
+	}
+}
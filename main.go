@@ -1,19 +1,63 @@
 package main
 
 import (
-	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app"
+	"flag"
+	"fmt"
 	"os"
+
+	"github.com/jagheterfredrik/wallbox-mqtt-bridge/app"
 )
 
+const usage = `Usage:
+  ./bridge bridge.ini                Run the bridge
+  ./bridge --config                  Interactive setup and service install
+  ./bridge check-config bridge.ini   Validate a config file
+  ./bridge status                    Show service and bridge status
+  ./bridge logs [journalctl args]    Show bridge logs
+  ./bridge sessions export [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--format csv|json] [--config bridge.ini]
+                                     Export charging sessions
+  ./bridge helper --token TOKEN [--listen 127.0.0.1:7070]
+                                     Forward commands from a bridge running off the charger
+  ./bridge uninstall [--purge]       Remove the service, --purge also removes the Home Assistant device`
+
 func main() {
-	if len(os.Args) != 2 {
-		panic("Usage: ./bridge --config or ./bridge bridge.ini")
+	if len(os.Args) < 2 {
+		panic(usage)
 	}
 	firstArgument := os.Args[1]
-	if firstArgument == "--config" {
+	switch firstArgument {
+	case "--config":
 		bridge.RunTuiSetup()
 		os.Exit(0)
-	} else {
+	case "check-config":
+		if len(os.Args) != 3 {
+			panic(usage)
+		}
+		if _, err := bridge.LoadConfig(os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(os.Args[2] + ": OK")
+	case "status":
+		bridge.RunStatus()
+	case "logs":
+		bridge.RunLogs(os.Args[2:])
+	case "sessions":
+		if len(os.Args) < 3 || os.Args[2] != "export" {
+			panic(usage)
+		}
+		bridge.RunSessionsExport(os.Args[3:])
+	case "helper":
+		bridge.RunHelper(os.Args[2:])
+	case "uninstall":
+		flags := flag.NewFlagSet("uninstall", flag.ExitOnError)
+		purge := flags.Bool("purge", false, "remove Home Assistant discovery topics")
+		flags.Parse(os.Args[2:])
+		bridge.RunUninstall(*purge)
+	default:
+		if len(os.Args) != 2 {
+			panic(usage)
+		}
 		bridge.LaunchBridge(firstArgument)
 	}
 }
@@ -1,4 +1,7 @@
 set -x
 
-CGO_ENABLED=0 GOOS=linux GOARCH=arm go build -ldflags="-s -w" -o bridge-armhf .
-CGO_ENABLED=0 GOOS=linux GOARCH=arm64 go build -ldflags="-s -w" -o bridge-arm64 .
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+LDFLAGS="-s -w -X github.com/jagheterfredrik/wallbox-mqtt-bridge/app.Version=$VERSION"
+
+CGO_ENABLED=0 GOOS=linux GOARCH=arm go build -ldflags="$LDFLAGS" -o bridge-armhf .
+CGO_ENABLED=0 GOOS=linux GOARCH=arm64 go build -ldflags="$LDFLAGS" -o bridge-arm64 .